@@ -163,10 +163,7 @@ func refreshUser(refr string, t *testing.T, expected int) map[string]string {
 func logoutUser(auth, refr string, t *testing.T) {
 	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/authorize", testServer), nil)
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", auth))
-	(&http.Client{}).Do(req)
-	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/authorize?refresh=true", testServer), nil)
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", refr))
-	(&http.Client{}).Do(req)
+	(&http.Client{}).Do(req) // ends the session, the refresh token goes with it
 }
 func insertDeviceReg(reg *auth.DeviceReg, t *testing.T, expected int) {
 	url := fmt.Sprintf("%s/devices", testServer)
@@ -313,7 +310,7 @@ func TestEnlistingAccs(t *testing.T) {
 	resp, err = (&http.Client{}).Do(req)
 	resp, err = (&http.Client{}).Do(req)
 	// expected response code is 401, since this req requires the user to have admin privileges
-	assert.Equal(t, 400, resp.StatusCode, "Unexpected response code when TestEnlistingAccs")
+	assert.Equal(t, 401, resp.StatusCode, "Unexpected response code when TestEnlistingAccs")
 	<-time.After(72 * time.Second)
 	// Now the authentication token should have expired
 	req, _ = http.NewRequest("GET", url, nil)
@@ -502,3 +499,130 @@ func TestUsrAccToDevices(t *testing.T) {
 	// // and then again everything is deleted
 	delUser(reg.User, toks["auth"], t, 200)
 }
+
+func listSessions(email, authTok string, t *testing.T, expected int) []map[string]interface{} {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/users/%s/sessions", testServer, email), nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authTok))
+	resp, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err, "Unexpected error in Do-ing the request, failed http request")
+	assert.Equal(t, expected, resp.StatusCode, "Unexpected response code when listSessions")
+	if resp.StatusCode != 200 {
+		return nil
+	}
+	defer resp.Body.Close()
+	target := []map[string]interface{}{}
+	if json.NewDecoder(resp.Body).Decode(&target) != nil {
+		t.Error("Failed to decode the sessions")
+	}
+	return target
+}
+
+// revokeSessions : id empty to logout everywhere
+func revokeSessions(email, id, authTok string, t *testing.T, expected int) {
+	url := fmt.Sprintf("%s/users/%s/sessions", testServer, email)
+	if id != "" {
+		url = fmt.Sprintf("%s/%s", url, id)
+	}
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authTok))
+	resp, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err, "Unexpected error in Do-ing the request, failed http request")
+	assert.Equal(t, expected, resp.StatusCode, "Unexpected response code when revokeSessions")
+}
+
+func TestSessions(t *testing.T) {
+	insertUser("kneerun@someshitdomain.com", "unjun@41993", "Niranjan Awati", "Pune, 411057", "+916734434353", 1, t, 200)
+	phone := authenticateUser("kneerun@someshitdomain.com", "unjun@41993", t, 200)
+	laptop := authenticateUser("kneerun@someshitdomain.com", "unjun@41993", t, 200)
+	tablet := authenticateUser("kneerun@someshitdomain.com", "unjun@41993", t, 200)
+
+	sessions := listSessions("kneerun@someshitdomain.com", phone["auth"], t, 200)
+	assert.Equal(t, 3, len(sessions), "Each login is a session")
+	listSessions("kneerunjun@gmail.com", phone["auth"], t, 403) // sessions of another user
+
+	// revoking the laptop session from the phone, laptop can neither authorize nor refresh
+	for _, s := range listSessions("kneerun@someshitdomain.com", laptop["auth"], t, 200) {
+		if s["current"] == true {
+			revokeSessions("kneerun@someshitdomain.com", fmt.Sprintf("%s", s["id"]), phone["auth"], t, 200)
+		}
+	}
+	authorizeUser(laptop["auth"], t, 0, 401)
+	refreshUser(laptop["refr"], t, 401)
+	authorizeUser(phone["auth"], t, 0, 200)
+	revokeSessions("kneerun@someshitdomain.com", "no-such-session", phone["auth"], t, 404)
+
+	// refreshing keeps to the same session, the refresh token cannot be used twice
+	phone = refreshUser(phone["refr"], t, 200)
+	assert.Equal(t, 2, len(listSessions("kneerun@someshitdomain.com", phone["auth"], t, 200)))
+
+	// admin logs the user out everywhere
+	revokeSessions("kneerun@someshitdomain.com", "", adminToks(t)["auth"], t, 200)
+	authorizeUser(phone["auth"], t, 0, 401)
+	authorizeUser(tablet["auth"], t, 0, 401)
+	refreshUser(tablet["refr"], t, 401)
+	delUser("kneerun@someshitdomain.com", adminToks(t)["auth"], t, 200)
+}
+
+func TestRefreshReuse(t *testing.T) {
+	insertUser("kneerun@someshitdomain.com", "unjun@41993", "Niranjan Awati", "Pune, 411057", "+916734434353", 1, t, 200)
+	toks := authenticateUser("kneerun@someshitdomain.com", "unjun@41993", t, 200)
+	stolen := toks["refr"]
+	toks = refreshUser(stolen, t, 200)
+	toks = refreshUser(toks["refr"], t, 200)
+	// the stolen refresh token used again ends the session, the tokens the app holds now are of no use either
+	refreshUser(stolen, t, 401)
+	refreshUser(toks["refr"], t, 401)
+	authorizeUser(toks["auth"], t, 0, 401)
+	assert.Equal(t, 0, len(listSessions("kneerun@someshitdomain.com", adminToks(t)["auth"], t, 200)))
+	delUser("kneerun@someshitdomain.com", adminToks(t)["auth"], t, 200)
+}
+
+func changeRole(email string, role int, authTok string, t *testing.T, expected int) {
+	body, _ := json.Marshal(map[string]int{"role": role})
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/users/%s/role", testServer, email), bytes.NewBuffer(body))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", authTok))
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := (&http.Client{}).Do(req)
+	assert.Nil(t, err, "Unexpected error in Do-ing the request, failed http request")
+	assert.Equal(t, expected, resp.StatusCode, "Unexpected response code when changeRole")
+	if expected != 200 {
+		t.Log(readResponseBody(resp, t))
+	}
+}
+
+// TestAccountChangeRevokes : tokens issued before the account changed are refused, not just on /authorize
+func TestAccountChangeRevokes(t *testing.T) {
+	email := "kneerun@someshitdomain.com"
+	// password changed, the tokens with whoever had the old password are of no use
+	insertUser(email, "unjun@41993", "Niranjan Awati", "Pune, 411057", "+916734434353", 1, t, 200)
+	old := authenticateUser(email, "unjun@41993", t, 200)
+	patchUser(email, "unjun@41994", t, 200)
+	putUser(email, "Niranjan Awati", "Pune, 411057", "+916734434353", old["auth"], t, 401)
+	refreshUser(old["refr"], t, 401)
+	toks := authenticateUser(email, "unjun@41994", t, 200)
+	putUser(email, "Niranjan Awati", "Pune, 411057", "+916734434353", toks["auth"], t, 200)
+
+	// role changed, the tokens carrying the old role are refused
+	changeRole(email, 0, toks["auth"], t, 403) // only admins change roles
+	changeRole(email, 3, adminToks(t)["auth"], t, 400)
+	changeRole("kneerunjun@gmail.com", 0, adminToks(t)["auth"], t, 403) // admins are immune
+	changeRole(email, 0, adminToks(t)["auth"], t, 200)
+	putUser(email, "Niranjan Awati", "Pune, 411057", "+916734434353", toks["auth"], t, 401)
+	refreshUser(toks["refr"], t, 401)
+	toks = authenticateUser(email, "unjun@41994", t, 200)
+	authorizeUser(toks["auth"], t, 1, 403) // signed in again with the new role
+	authorizeUser(toks["auth"], t, 0, 200)
+
+	// account deleted, the tokens go with it
+	delUser(email, adminToks(t)["auth"], t, 200)
+	putUser(email, "Niranjan Awati", "Pune, 411057", "+916734434353", toks["auth"], t, 401)
+	authorizeUser(toks["auth"], t, 0, 401)
+	refreshUser(toks["refr"], t, 401)
+
+	// registering again with the same email does not bring the tokens back
+	insertUser(email, "unjun@41993", "Niranjan Awati", "Pune, 411057", "+916734434353", 1, t, 200)
+	putUser(email, "Niranjan Awati", "Pune, 411057", "+916734434353", toks["auth"], t, 401)
+	toks = authenticateUser(email, "unjun@41993", t, 200)
+	authorizeUser(toks["auth"], t, 1, 200)
+	delUser(email, adminToks(t)["auth"], t, 200)
+}
@@ -0,0 +1,103 @@
+package main
+
+// Tasks that run in the background for as long as the api is up
+
+import (
+	"net/http"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	"github.com/eensymachines-in/authapi/handlers"
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+)
+
+// flushHeartbeats : periodically moves the device heartbeats from the cache to the database
+func flushHeartbeats(every time.Duration) {
+	for range time.Tick(every) {
+		session, err := mgo.Dial("srvmongo")
+		if err != nil {
+			log.Errorf("flushHeartbeats: failed to connect to database %s", err)
+			continue
+		}
+		cache := &auth.TokenCache{Client: redis.NewClient(&redis.Options{
+			Addr:     "srvredis:6379",
+			Password: "", // no password set
+			DB:       0,  // use default DB
+		})}
+		count, err := handlers.FlushHeartbeats(cache, session.DB("autolumin").C("devhealth"))
+		if err != nil {
+			log.Errorf("flushHeartbeats: %s", err)
+		} else if count > 0 {
+			log.Debugf("flushHeartbeats: flushed heartbeats of %d devices", count)
+		}
+		cache.Close()
+		session.Close()
+	}
+}
+
+// runLockSchedules : applies the lock schedules every minute, and once right away at start
+// schedule state is in the database so transitions missed while the api was down are applied on the first run
+func runLockSchedules() {
+	apply := func() {
+		session, err := mgo.Dial("srvmongo")
+		if err != nil {
+			log.Errorf("runLockSchedules: failed to connect to database %s", err)
+			return
+		}
+		defer session.Close()
+		db := session.DB("autolumin")
+		count, err := handlers.ApplySchedules(db.C("lockschedules"), &auth.DeviceRegColl{Collection: db.C("devreg")}, db.C("devgroups"), time.Now())
+		if err != nil {
+			log.Errorf("runLockSchedules: %s", err)
+		}
+		if count > 0 {
+			log.Infof("runLockSchedules: %d schedules transitioned", count)
+		}
+	}
+	apply()
+	for range time.Tick(time.Minute) {
+		apply()
+	}
+}
+
+// dispatchWebhooks : posts the webhook deliveries that are due, failed ones are retried with backoff
+func dispatchWebhooks(every time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for range time.Tick(every) {
+		session, err := mgo.Dial("srvmongo")
+		if err != nil {
+			log.Errorf("dispatchWebhooks: failed to connect to database %s", err)
+			continue
+		}
+		db := session.DB("autolumin")
+		count, err := handlers.DeliverDue(db.C("webhooks"), db.C("whdeliveries"), client, time.Now().UTC())
+		if err != nil {
+			log.Errorf("dispatchWebhooks: %s", err)
+		} else if count > 0 {
+			log.Debugf("dispatchWebhooks: attempted %d deliveries", count)
+		}
+		session.Close()
+	}
+}
+
+// sampleDevices : device counts for the metrics, sampled rather than counted per request
+func sampleDevices(every time.Duration) {
+	sample := func() {
+		session, err := mgo.Dial("srvmongo")
+		if err != nil {
+			log.Errorf("sampleDevices: failed to connect to database %s", err)
+			return
+		}
+		defer session.Close()
+		db := session.DB("autolumin")
+		if err := handlers.SampleDevices(db.C("devreg"), db.C("devblacklist")); err != nil {
+			log.Errorf("sampleDevices: %s", err)
+		}
+	}
+	sample()
+	for range time.Tick(every) {
+		sample()
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	"github.com/eensymachines-in/authapi/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+// duration : time.Duration that can be read from json as "90s", "5m"
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON : reads the duration in the string form
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration has to be a string like 90s: %s", err)
+	}
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = val
+	return nil
+}
+
+// MarshalJSON : writes out the duration in the string form
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// Config : settings for the api that are not secrets
+// read from a json file on the host, whatever isnt in the file stays at its default
+type Config struct {
+	// a device not heard from in this much time is offline
+	HeartbeatTimeout duration `json:"heartbeat_timeout"`
+	// heartbeats are cached and flushed to the database every so often
+	HeartbeatFlush duration `json:"heartbeat_flush"`
+	// due webhook deliveries are posted every so often
+	WebhookDispatch duration `json:"webhook_dispatch"`
+	// device commands not acknowledged in this time expire
+	CommandTTL duration `json:"command_ttl"`
+	// tcp://host:1883 to push device commands over mqtt, empty for long-poll only
+	MQTTBroker string `json:"mqtt_broker"`
+	// username the api connects to the broker with, the broker auth plugin takes it as the superuser
+	MQTTUser string `json:"mqtt_user"`
+	// device counts for the metrics are sampled every so often
+	MetricsSample duration `json:"metrics_sample"`
+	// log fields that are personal data, masked in the logs along with the credentials
+	LogPII []string `json:"log_pii"`
+	// where the traces go, tracing is off when there is no exporter
+	Tracing TracingConfig `json:"tracing"`
+	// listener, timeouts and tls
+	Server ServerConfig `json:"server"`
+	// cross origin requests from the browser apps
+	CORS CORSConfig `json:"cors"`
+	// security headers and request body limits
+	Security SecurityConfig `json:"security"`
+	// lifetimes of the tokens issued on login and refresh, and the claims on them
+	Tokens TokensConfig `json:"tokens"`
+}
+
+// TokenTTLConfig : lifetimes of the access and the refresh token, what is left out is not overridden
+type TokenTTLConfig struct {
+	Access  duration `json:"access"`
+	Refresh duration `json:"refresh"`
+}
+
+// TokensConfig : token lifetimes by the role and the client, the client can only shorten the lifetimes of the role
+type TokensConfig struct {
+	Access  duration `json:"access"`
+	Refresh duration `json:"refresh"`
+	// keyed on the role - 0, 1, 2
+	Roles map[int]TokenTTLConfig `json:"roles"`
+	// keyed on the client the app says it is in the X-Client-Type header - web, mobile
+	Clients map[string]TokenTTLConfig `json:"clients"`
+	// lifetime of the device tokens issued on registration and rotation
+	Device duration `json:"device"`
+	// refreshing extends the session by the refresh lifetime, else the session ends when the first refresh token would have
+	Sliding bool `json:"sliding"`
+	// no session lives beyond this from the login, sliding or not. 0 for no limit
+	MaxSession duration `json:"max_session"`
+	// claims on the tokens, left out when not set - org, perms for the role and sid the session id
+	Org          string           `json:"org"`
+	Permissions  map[int][]string `json:"permissions"`
+	SessionClaim bool             `json:"session_claim"`
+}
+
+// policy : the config as the handlers take it
+func (tc TokensConfig) policy() *handlers.TokenPolicy {
+	ttl := func(t TokenTTLConfig) handlers.TokenTTL {
+		return handlers.TokenTTL{Access: t.Access.Duration, Refresh: t.Refresh.Duration}
+	}
+	tp := &handlers.TokenPolicy{
+		Default:      ttl(TokenTTLConfig{Access: tc.Access, Refresh: tc.Refresh}),
+		Roles:        map[int]handlers.TokenTTL{},
+		Clients:      map[string]handlers.TokenTTL{},
+		Device:       tc.Device.Duration,
+		Sliding:      tc.Sliding,
+		MaxSession:   tc.MaxSession.Duration,
+		Org:          tc.Org,
+		Permissions:  tc.Permissions,
+		SessionClaim: tc.SessionClaim,
+	}
+	for role, t := range tc.Roles {
+		tp.Roles[role] = ttl(t)
+	}
+	for client, t := range tc.Clients {
+		tp.Clients[client] = ttl(t)
+	}
+	return tp
+}
+
+// SecurityConfig : response headers for the browsers and limits on what the clients can send
+type SecurityConfig struct {
+	// Strict-Transport-Security, sent only on requests that came over https, 0 to leave it out
+	HSTSMaxAge duration `json:"hsts_max_age"`
+	// bytes, request bodies larger than this are refused with 413
+	MaxBody int64 `json:"max_body"`
+	// limits for the routes that need other than max_body, keyed on the method and the route template - "POST /devices/:serial/heartbeat"
+	RouteMaxBody map[string]int64 `json:"route_max_body"`
+}
+
+// CORSConfig : origins that the browser apps are served from, and what they can send
+type CORSConfig struct {
+	// exact origins - https://app.eensymachines.in, patterns - https://*.eensymachines.in or * for any origin
+	// none by default, only same origin requests then
+	AllowOrigins []string `json:"allow_origins"`
+	AllowMethods []string `json:"allow_methods"`
+	AllowHeaders []string `json:"allow_headers"`
+	// response headers the browser apps can read beyond the simple ones
+	ExposeHeaders []string `json:"expose_headers"`
+	// cookies and the authorization header on cross origin requests, the origin is then echoed back and never *
+	// cannot go with * in the origins, that would let any site make requests with the user's credentials
+	AllowCredentials bool `json:"allow_credentials"`
+	// browsers cache the preflight for this long
+	MaxAge duration `json:"max_age"`
+}
+
+// validate : credentials only for the origins listed
+func (cc CORSConfig) validate() error {
+	if !cc.AllowCredentials {
+		return nil
+	}
+	for _, o := range cc.AllowOrigins {
+		if strings.TrimSpace(o) == "*" {
+			return fmt.Errorf("cors allow_origins * cannot go with allow_credentials, list the origins instead")
+		}
+	}
+	return nil
+}
+
+// ServerConfig : the http server, timeouts guard against clients that hold connections open without sending or reading
+type ServerConfig struct {
+	Addr string `json:"addr"`
+	// broker auth plugin and the prometheus scrape, plain http on the internal network only - never publish this port
+	InternalAddr      string   `json:"internal_addr"`
+	ReadTimeout       duration `json:"read_timeout"`        // whole request including the body
+	ReadHeaderTimeout duration `json:"read_header_timeout"` // request headers only
+	WriteTimeout      duration `json:"write_timeout"`       // event streams and long-polls extend this on their own
+	IdleTimeout       duration `json:"idle_timeout"`        // keep-alive connections between requests
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+	// requests in flight at shutdown are given this long to complete
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+	// pem files, serves https when both are set. Files are reloaded when they change, renewed certificates need no restart
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// certificate files are checked for changes this often
+	TLSReload duration `json:"tls_reload"`
+}
+
+// TracingConfig : opentelemetry exporter and sampling
+type TracingConfig struct {
+	// stdout for local runs, otlp for a collector, empty to switch tracing off
+	Exporter string `json:"exporter"`
+	// host:port of the otlp collector over http, 4318 by default on the collector
+	Endpoint string `json:"endpoint"`
+	// plain http to the collector
+	Insecure bool `json:"insecure"`
+	// fraction of the root requests traced, requests with a sampled parent are always traced
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// defaultConfig : config that the api runs with when there is no config file
+func defaultConfig() *Config {
+	return &Config{
+		HeartbeatTimeout: duration{2 * time.Minute},
+		HeartbeatFlush:   duration{30 * time.Second},
+		WebhookDispatch:  duration{10 * time.Second},
+		CommandTTL:       duration{24 * time.Hour},
+		MQTTUser:         "authapi",
+		MetricsSample:    duration{time.Minute},
+		LogPII:           []string{"email", "phone", "name", "loc"},
+		Tracing:          TracingConfig{Endpoint: "localhost:4318", SampleRatio: 1},
+		CORS: CORSConfig{
+			AllowOrigins:  []string{}, // same origin only, the origins of the apps are set for each environment
+			AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowHeaders:  []string{"Authorization", "Content-Type", "X-Request-ID", "X-Client-Type", "traceparent", "tracestate"},
+			ExposeHeaders: []string{"X-Request-ID"},
+			MaxAge:        duration{10 * time.Minute},
+		},
+		Security: SecurityConfig{
+			HSTSMaxAge: duration{365 * 24 * time.Hour},
+			MaxBody:    1 << 16,
+			RouteMaxBody: map[string]int64{
+				"POST /devices/:serial/heartbeat": 1 << 12,
+				"POST /mqtt/user":                 1 << 12,
+				"POST /mqtt/superuser":            1 << 12,
+				"POST /mqtt/acl":                  1 << 12,
+			},
+		},
+		Tokens: TokensConfig{
+			Access:  duration{auth.AuthExp},
+			Refresh: duration{auth.RefrExp},
+			Device:  duration{handlers.DeviceTokExp},
+			Sliding: true,
+		},
+		Server: ServerConfig{
+			Addr:              ":8080",
+			InternalAddr:      ":8081",
+			ReadTimeout:       duration{15 * time.Second},
+			ReadHeaderTimeout: duration{5 * time.Second},
+			WriteTimeout:      duration{30 * time.Second},
+			IdleTimeout:       duration{2 * time.Minute},
+			MaxHeaderBytes:    1 << 16,
+			ShutdownTimeout:   duration{20 * time.Second},
+			TLSReload:         duration{time.Minute},
+		},
+	}
+}
+
+// loadConfig : reads the config file over the defaults
+// a missing file is not an error, the api runs with defaults
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Warnf("No config file at %s, running with defaults", path)
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %s", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// validate : intervals and lifetimes the api ticks or expires on have to be more than 0
+// a ticker on 0 panics and time.Tick on 0 never fires
+func (cfg *Config) validate() error {
+	for name, d := range map[string]duration{
+		"heartbeat_timeout":       cfg.HeartbeatTimeout,
+		"heartbeat_flush":         cfg.HeartbeatFlush,
+		"webhook_dispatch":        cfg.WebhookDispatch,
+		"command_ttl":             cfg.CommandTTL,
+		"metrics_sample":          cfg.MetricsSample,
+		"server.shutdown_timeout": cfg.Server.ShutdownTimeout,
+		"server.tls_reload":       cfg.Server.TLSReload,
+	} {
+		if d.Duration <= 0 {
+			return fmt.Errorf("%s has to be more than 0, got %s", name, d.Duration)
+		}
+	}
+	return cfg.CORS.validate()
+}
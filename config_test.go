@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadConfigDurations : intervals that are 0 or less are refused when the config is read, not when a ticker panics on them
+func TestLoadConfigDurations(t *testing.T) {
+	load := func(body string) error {
+		f, err := ioutil.TempFile("", "authapi-config-*.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(body)
+		f.Close()
+		_, err = loadConfig(f.Name())
+		return err
+	}
+	assert.Nil(t, load(`{"heartbeat_flush":"45s","server":{"tls_reload":"5m"}}`))
+	tests := []struct {
+		body string
+		key  string
+	}{
+		{`{"heartbeat_flush":"0s"}`, "heartbeat_flush"},
+		{`{"webhook_dispatch":"-10s"}`, "webhook_dispatch"},
+		{`{"metrics_sample":"0s"}`, "metrics_sample"},
+		{`{"heartbeat_timeout":"-1m"}`, "heartbeat_timeout"},
+		{`{"command_ttl":"0s"}`, "command_ttl"},
+		{`{"server":{"tls_reload":"0s"}}`, "server.tls_reload"},
+		{`{"server":{"shutdown_timeout":"-5s"}}`, "server.shutdown_timeout"},
+	}
+	for _, tt := range tests {
+		err := load(tt.body)
+		if assert.NotNil(t, err, tt.body) {
+			assert.Contains(t, err.Error(), tt.key)
+		}
+	}
+	assert.NotNil(t, load(`{"cors":{"allow_origins":["*"],"allow_credentials":true}}`), "cors is still validated")
+}
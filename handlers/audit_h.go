@@ -0,0 +1,274 @@
+package handlers
+
+// Append only audit trail of who did what to which account or device
+// every entry carries the hash of the entry before it, editing or removing an entry breaks the chain from there on
+// the chain is over the hashes of the actor and target and not the values, so erasure can pseudonymise them without breaking it
+// the hashes are keyed with HASH_SECRET, the emails cannot be had back from them by hashing a list of emails
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// outcomes of the audited action
+const (
+	AuditOk     = "ok"
+	AuditDenied = "denied" // 401, 403
+	AuditFailed = "failed"
+)
+
+// AuditEntry : one action on the api
+type AuditEntry struct {
+	Seq        int64     `json:"seq" bson:"_id"`
+	At         time.Time `json:"at" bson:"at"`
+	RequestID  string    `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Actor      string    `json:"actor" bson:"actor"` // user email or device serial, empty when anonymous
+	ActorHash  string    `json:"actor_hash" bson:"actor_hash"`
+	Role       int       `json:"role" bson:"role"`
+	Action     string    `json:"action" bson:"action"`
+	Target     string    `json:"target" bson:"target"`
+	TargetHash string    `json:"target_hash" bson:"target_hash"`
+	Detail     string    `json:"detail,omitempty" bson:"detail,omitempty"`
+	Outcome    string    `json:"outcome" bson:"outcome"`
+	Status     int       `json:"status" bson:"status"`
+	IP         string    `json:"ip" bson:"ip"`
+	UserAgent  string    `json:"ua" bson:"ua"`
+	Prev       string    `json:"prev" bson:"prev"`
+	Hash       string    `json:"hash" bson:"hash"`
+}
+
+// auditValHash : keyed hash of the actor/target that the chain is computed over
+func auditValHash(val string) string {
+	if val == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(os.Getenv("HASH_SECRET")))
+	mac.Write([]byte(strings.ToLower(val)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditValFits : the value is what was hashed, or the pseudonym erasure gave it in place of what was hashed
+// any other value in place of the one hashed breaks the chain
+func auditValFits(val, valHash string) bool {
+	if valHash == auditValHash(val) {
+		return true
+	}
+	return valHash != "" && val == pseudonymOf(valHash)
+}
+
+// chainHash : keyed hash of the entry along with the hash of the entry before it
+// without the key the chain cannot be written over from the start with hashes that verify
+func (ae *AuditEntry) chainHash() string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("HASH_SECRET")))
+	mac.Write([]byte(strings.Join([]string{
+		strconv.FormatInt(ae.Seq, 10), ae.At.UTC().Format(time.RFC3339Nano), ae.RequestID, ae.ActorHash, strconv.Itoa(ae.Role),
+		ae.Action, ae.TargetHash, ae.Detail, ae.Outcome, strconv.Itoa(ae.Status), ae.IP, ae.UserAgent, ae.Prev,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditOutcome : outcome from the http status of the response
+func AuditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	case status >= 400:
+		return AuditFailed
+	}
+	return AuditOk
+}
+
+// AuditLog : appends to the audit trail
+type AuditLog struct {
+	session *mgo.Session
+}
+
+// Audit : the trail the middleware and the handlers record on, set up by main
+// when nil nothing is recorded
+var Audit *AuditLog
+
+// NewAuditLog : audit trail in the audit collection
+func NewAuditLog(session *mgo.Session) *AuditLog {
+	return &AuditLog{session: session}
+}
+
+// appendAudit : links the entry to the last one and inserts it
+// sequence is the _id, so two appends racing for the same place cannot both get in - the loser retries on the new head
+func appendAudit(coll *mgo.Collection, ae *AuditEntry) error {
+	ae.At = ae.At.UTC().Truncate(time.Millisecond) // database keeps millisecond precision, the hash has to match what is read back
+	ae.ActorHash, ae.TargetHash = auditValHash(ae.Actor), auditValHash(ae.Target)
+	for i := 0; i < 10; i++ {
+		head := &AuditEntry{}
+		if err := coll.Find(nil).Sort("-_id").One(head); err != nil && err != mgo.ErrNotFound {
+			return ex.NewErr(&ex.ErrQuery{}, err, "Failed to read audit trail", "appendAudit/coll.Find().One()")
+		}
+		ae.Seq, ae.Prev = head.Seq+1, head.Hash
+		ae.Hash = ae.chainHash()
+		err := coll.Insert(ae)
+		if err == nil {
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return ex.NewErr(&ex.ErrQuery{}, err, "Failed to append to audit trail", "appendAudit/coll.Insert()")
+		}
+	}
+	return ex.NewErr(&ex.ErrQuery{}, fmt.Errorf("too many concurrent appends"), "Failed to append to audit trail", "appendAudit")
+}
+
+// Record : appends the entry, errors are logged since the action has already happened
+func (al *AuditLog) Record(ae *AuditEntry) {
+	if al == nil {
+		return
+	}
+	sess := al.session.Copy()
+	defer sess.Close()
+	if err := appendAudit(sess.DB("autolumin").C("audit"), ae); err != nil {
+		log.Errorf("AuditLog.Record: failed to record %s on %s: %s", ae.Action, ae.Target, err)
+	}
+}
+
+// pseudonymiseAudit : replaces the email as actor or target with its pseudonym, hashes in the chain remain as they were
+// the pseudonym is the one of the hash on the entry
+func pseudonymiseAudit(coll *mgo.Collection, email string) error {
+	h := auditValHash(email)
+	anon := pseudonymOf(h)
+	if _, err := coll.UpdateAll(bson.M{"actor": email, "actor_hash": h}, bson.M{"$set": bson.M{"actor": anon}}); err != nil {
+		return ex.NewErr(&ex.ErrQuery{}, err, "Failed to anonymise audit trail", "pseudonymiseAudit/actor")
+	}
+	if _, err := coll.UpdateAll(bson.M{"target": email, "target_hash": h}, bson.M{"$set": bson.M{"target": anon}}); err != nil {
+		return ex.NewErr(&ex.ErrQuery{}, err, "Failed to anonymise audit trail", "pseudonymiseAudit/target")
+	}
+	return nil
+}
+
+// userAudit : entries where the user is the actor or the target
+func userAudit(coll *mgo.Collection, email string) ([]AuditEntry, error) {
+	result := []AuditEntry{}
+	if err := coll.Find(bson.M{"$or": []bson.M{{"actor": email}, {"target": email}}}).Sort("_id").All(&result); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get audit trail", "userAudit/coll.Find().All()")
+	}
+	return result, nil
+}
+
+// VerifyAudit : walks the chain from the start, sends back the count of entries checked and the first one that does not fit
+// broken is 0 when the chain is intact
+func VerifyAudit(coll *mgo.Collection) (checked int, broken int64, err error) {
+	iter := coll.Find(nil).Sort("_id").Iter()
+	prev, want := "", int64(1)
+	ae := AuditEntry{}
+	for iter.Next(&ae) {
+		checked++
+		if ae.Seq != want || ae.Prev != prev || ae.Hash != ae.chainHash() ||
+			!auditValFits(ae.Actor, ae.ActorHash) || !auditValFits(ae.Target, ae.TargetHash) {
+			iter.Close()
+			return checked, want, nil
+		}
+		prev, want = ae.Hash, want+1
+	}
+	if err := iter.Close(); err != nil {
+		return checked, 0, ex.NewErr(&ex.ErrQuery{}, err, "Failed to read audit trail", "VerifyAudit/iter.Close()")
+	}
+	return checked, 0, nil
+}
+
+// auditFilter : /audit?actor=&action=&target=&outcome=&from=&to=&after=
+func auditFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+	for _, k := range []string{"actor", "action", "target", "outcome"} {
+		if v := c.Query(k); v != "" {
+			filter[k] = v
+		}
+	}
+	at := bson.M{}
+	for k, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		if v := c.Query(k); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, ex.NewErr(&ex.ErrInvalid{}, err, fmt.Sprintf("Invalid %s, expected RFC3339 time", k), "auditFilter")
+			}
+			at[op] = t.UTC()
+		}
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	if v := c.Query("after"); v != "" {
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Invalid after, expected the seq of an entry", "auditFilter")
+		}
+		filter["_id"] = bson.M{"$gt": seq}
+	}
+	return filter, nil
+}
+
+// HandlAudit : querying the audit trail
+// ?format=jsonl exports all the matching entries as json lines, otherwise pages of ?limit= with ?after=<last seq>
+func HandlAudit(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("audit")
+	coll := val.(*mgo.Collection)
+	filter, err := auditFilter(c)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	if c.Query("format") == "jsonl" {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.jsonl\"", time.Now().UTC().Format("20060102T150405")))
+		c.Status(http.StatusOK)
+		w := bufio.NewWriter(c.Writer)
+		enc := json.NewEncoder(w)
+		iter := coll.Find(filter).Sort("_id").Iter()
+		ae := AuditEntry{}
+		for iter.Next(&ae) {
+			enc.Encode(ae) // newline after each entry
+		}
+		if err := iter.Close(); err != nil {
+			// headers are out, the export ends short
+			Logger(c).Errorf("HandlAudit: export cut short %s", err)
+		}
+		w.Flush()
+		return
+	}
+	limit, _, err := intQuery(c, "limit")
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	result := []AuditEntry{}
+	if err := coll.Find(filter).Sort("_id").Limit(limit).All(&result); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get audit trail", "HandlAudit/coll.Find().All()"), c)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// HandlAuditVerify : checks the hash chain end to end
+func HandlAuditVerify(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("audit")
+	checked, broken, err := VerifyAudit(val.(*mgo.Collection))
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": broken == 0, "checked": checked, "broken_at": broken})
+}
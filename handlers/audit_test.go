@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAuditValFits : only the value hashed, or the pseudonym erasure gives it, passes for the hash on the entry
+func TestAuditValFits(t *testing.T) {
+	defer os.Setenv("HASH_SECRET", os.Getenv("HASH_SECRET"))
+	os.Setenv("HASH_SECRET", "k3y")
+	email := "someone@gmail.com"
+	h := auditValHash(email)
+	assert.True(t, auditValFits(email, h))
+	assert.True(t, auditValFits(pseudonym(email), h), "erased")
+	assert.False(t, auditValFits("erased-whatever", h))
+	assert.False(t, auditValFits(pseudonym("other@gmail.com"), h))
+	assert.False(t, auditValFits("other@gmail.com", h))
+	assert.True(t, auditValFits("", ""))
+
+	os.Setenv("HASH_SECRET", "0th3r")
+	assert.NotEqual(t, h, auditValHash(email), "another key, another hash")
+}
+
+// TestChainHash : the chain is keyed, the same entry under another key does not verify
+func TestChainHash(t *testing.T) {
+	defer os.Setenv("HASH_SECRET", os.Getenv("HASH_SECRET"))
+	os.Setenv("HASH_SECRET", "k3y")
+	ae := &AuditEntry{Seq: 2, At: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC), Action: "device.patch", Outcome: AuditOk, Status: 200, Prev: "abc"}
+	h := ae.chainHash()
+	assert.Equal(t, h, ae.chainHash())
+	sum := sha256.Sum256([]byte(strings.Join([]string{"2", ae.At.Format(time.RFC3339Nano), "", "", "0", "device.patch", "", "", AuditOk, "200", "", "", "abc"}, "\n")))
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), h, "plain hash of the entry is not the chain hash")
+	os.Setenv("HASH_SECRET", "0th3r")
+	assert.NotEqual(t, h, ae.chainHash(), "another key, another hash")
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	auth "github.com/eensymachines-in/auth/v2"
 	ex "github.com/eensymachines-in/errx"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 )
 
 // getTknCacFromCtx : extracts the cache pointer from the context inserted by the middleware
@@ -17,12 +19,12 @@ func getTknCacFromCtx(c *gin.Context) (*auth.TokenCache, func()) {
 	val, exists := c.Get("cache")
 	if !exists {
 		// c.AbortWithStatus(http.StatusBadGateway)
-		ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("No cache connection found middleware"), "One or more gateways on the server has failed", "getTknCacFromCtx"), c)
+		DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("No cache connection found middleware"), "One or more gateways on the server has failed", "getTknCacFromCtx"), c)
 		return nil, nil
 	}
 	tokCach := val.(*auth.TokenCache)
 	if tokCach == nil {
-		ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Invalid type of cache connection in middleware"), "One or more gateways on the server has failed", "getTknCacFromCtx"), c)
+		DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Invalid type of cache connection in middleware"), "One or more gateways on the server has failed", "getTknCacFromCtx"), c)
 		// c.AbortWithStatus(http.StatusBadGateway)
 		return nil, nil
 	}
@@ -36,7 +38,7 @@ func getTknCacFromCtx(c *gin.Context) (*auth.TokenCache, func()) {
 func getTknFromCtx(c *gin.Context) *auth.JWTok {
 	val, exists := c.Get("token")
 	if !exists {
-		ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No token string found in header"), "This request requires authorization, no authorization was provided", "getTknFromCtx"), c)
+		DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No token string found in header"), "This request requires authorization, no authorization was provided", "getTknFromCtx"), c)
 		// c.AbortWithStatus(http.StatusUnauthorized)
 		return nil
 	}
@@ -55,20 +57,25 @@ func HndlAuthrz(c *gin.Context) {
 	if c.Request.Method == "GET" {
 		if c.Query("refresh") == "true" {
 			pair := &auth.TokenPair{}
-			if ex.DigestErr(tokCach.RefreshUser(getTknFromCtx(c), pair), c) != 0 {
+			// refrTokenParse has claimed the token, the session is the one it was on
+			err := refreshSession(tokCach, c.GetString("refr_session"), getTknFromCtx(c), pair)
+			refreshTotal.WithLabelValues(outcome(err)).Inc()
+			if DigestErr(err, c) != 0 {
 				return
 			}
 			c.JSON(http.StatusOK, pair.MakeMarshalable(os.Getenv("AUTH_SECRET"), os.Getenv("REFR_SECRET")))
 			return
 		}
 		// Now getting the token state
-		if ex.DigestErr(tokCach.TokenStatus(getTknFromCtx(c)), c) != 0 {
+		if DigestErr(tokCach.TokenStatus(getTknFromCtx(c)), c) != 0 {
 			return
 		}
 		c.AbortWithStatus(http.StatusOK)
 		return
 	} else if c.Request.Method == "DELETE" {
-		if ex.DigestErr(tokCach.LogoutToken(getTknFromCtx(c)), c) != 0 {
+		err := logoutSession(tokCach, getTknFromCtx(c))
+		logoutTotal.WithLabelValues(outcome(err)).Inc()
+		if DigestErr(err, c) != 0 {
 			return
 		}
 		c.AbortWithStatus(http.StatusOK)
@@ -77,6 +84,19 @@ func HndlAuthrz(c *gin.Context) {
 
 }
 
+// tokenReused : refresh token used a second time, it is likely to have been stolen
+// the session has been revoked already, this records it for the admins and the subscribers
+func tokenReused(c *gin.Context, refr *auth.JWTok, s *Session) {
+	Logger(c).WithFields(log.Fields{"user_hash": UserHash(refr.User), "session": s.ID}).Warn("Refresh token reused, session revoked")
+	Audit.Record(&AuditEntry{
+		At: time.Now(), RequestID: c.GetString("request_id"),
+		Actor: refr.User, Role: refr.Role, Action: "token.reuse", Target: refr.User,
+		Detail:  fmt.Sprintf("session=%s", s.ID),
+		Outcome: AuditDenied, Status: http.StatusUnauthorized, IP: c.ClientIP(), UserAgent: c.Request.UserAgent(),
+	})
+	Events.Publish(EvTokenReused, refr.User, gin.H{"session": s.ID, "ip": c.ClientIP(), "user_agent": c.Request.UserAgent(), "session_ip": s.IP})
+}
+
 // HandlAuth : login and authnetication only
 func HandlAuth(c *gin.Context) {
 	// +++++++++++++++++++++++++
@@ -99,19 +119,43 @@ func HandlAuth(c *gin.Context) {
 	e, _ := c.Get("email")
 	p, _ := c.Get("passwd")
 	creds := &auth.UserAcc{Email: fmt.Sprintf("%v", e), Passwd: fmt.Sprintf("%v", p)}
-	details, err := usrRegColl.AccountDetails(creds.Email)
-	if ex.DigestErr(err, c) != 0 {
+	client, err := clientType(c) // token lifetimes are by the client
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	// generation is read before the account, a change to the account in between leaves the tokens of the older generation
+	gen, err := TokenGens.Current(creds.Email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	var details *auth.UserAccDetails
+	err = traceCall(c, "mongo.AccountDetails", func() (err error) {
+		details, err = usrRegColl.AccountDetails(creds.Email)
+		return
+	})
+	if DigestErr(err, c) != 0 {
+		loginsTotal.WithLabelValues("failed").Inc()
 		return
 	}
 	creds.Role = details.Role // getting the role from the credentials in the payload
-	_, err = usrRegColl.Authenticate(creds)
-	if ex.DigestErr(err, c) != 0 {
+	err = traceCall(c, "bcrypt.Authenticate", func() (err error) {
+		// reads the account and compares the password hash, bcrypt is where the time goes
+		_, err = usrRegColl.Authenticate(creds)
+		return
+	})
+	loginsTotal.WithLabelValues(outcome(err)).Inc()
+	if DigestErr(err, c) != 0 {
+		Events.Publish(EvLoginFailed, creds.Email, gin.H{"email": creds.Email, "ip": c.ClientIP()})
 		return
 	} //error itself will indicate that creds have not been authenticated
 
 	// +++++++++++++++++ now time to create tokens and udpate the cache
-	tokPair := &auth.TokenPair{}
-	if ex.DigestErr(tokCach.LoginUser(creds.Email, creds.Role, tokPair), c) != 0 {
+	var tokPair *auth.TokenPair
+	err = traceCall(c, "redis.startSession", func() (err error) {
+		tokPair, err = startSession(tokCach, creds.Email, creds.Role, client, gen, c)
+		return
+	})
+	if DigestErr(err, c) != 0 {
 		return
 	}
 	// ahead of issue #24 - the authentication api needs to send the tokens and the account information
@@ -0,0 +1,278 @@
+package handlers
+
+// Commands queued for the devices so that state changes reach them without waiting on a poll of the device status
+// devices long-poll for their commands (or get them pushed over mqtt) and acknowledge each one
+// commands not acknowledged before they expire are left expired, and can be listed to find devices that are not listening
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	CmdLock   = "lock"
+	CmdUnlock = "unlock"
+	CmdReboot = "reboot"
+	CmdRotate = "rotate-credential"
+)
+
+var (
+	// CommandTTL : commands not acknowledged in this time expire
+	CommandTTL = 24 * time.Hour
+	// CommandPush : pushes the command to the device as soon as it is queued, nil when there is no broker
+	// devices still have to acknowledge, pushed commands are also delivered on the long-poll till then
+	CommandPush func(cmd *DevCommand) error
+	// PollSession : long-polls run on copies of this session instead of holding the one dialed for the request, set up by main
+	PollSession *mgo.Session
+	// longPollMax : longest a device can wait on the commands
+	longPollMax = 60 * time.Second
+	// pollFirst, pollMax : interval between the checks for commands while long-polling, doubles from first up to max
+	pollFirst = time.Second
+	pollMax   = 8 * time.Second
+)
+
+var devCommands = map[string]bool{CmdLock: true, CmdUnlock: true, CmdReboot: true, CmdRotate: true}
+
+// DevCommand : command for the device
+type DevCommand struct {
+	ID          bson.ObjectId `json:"id" bson:"_id"`
+	Serial      string        `json:"serial" bson:"serial"`
+	Cmd         string        `json:"cmd" bson:"cmd"`
+	By          string        `json:"by,omitempty" bson:"by,omitempty"`         // user that sent the command, empty when the api did
+	Status      string        `json:"status" bson:"status"`                     // pending / delivered / acked / failed / expired / superseded
+	Result      string        `json:"result,omitempty" bson:"result,omitempty"` // as reported by the device on ack
+	Created     time.Time     `json:"created" bson:"created"`
+	Expires     time.Time     `json:"expires" bson:"expires"`
+	DeliveredAt *time.Time    `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	AckedAt     *time.Time    `json:"acked_at,omitempty" bson:"acked_at,omitempty"`
+}
+
+// unacked : filter for the commands the device is yet to acknowledge
+func unacked() bson.M {
+	return bson.M{"status": bson.M{"$in": []string{"pending", "delivered"}}}
+}
+
+// expireCommands : marks the unacknowledged commands past their expiry
+func expireCommands(cmds *mgo.Collection, now time.Time) error {
+	filter := unacked()
+	filter["expires"] = bson.M{"$lte": now}
+	if _, err := cmds.UpdateAll(filter, bson.M{"$set": bson.M{"status": "expired"}}); err != nil {
+		return ex.NewErr(&ex.ErrQuery{}, err, "Failed to expire device commands", "expireCommands/cmds.UpdateAll()")
+	}
+	return nil
+}
+
+// queueCommand : queues the command for the device
+// lock and unlock supersede any lock or unlock still pending, the device only needs the latest state
+func queueCommand(cmds *mgo.Collection, serial, cmd, by string) (*DevCommand, error) {
+	if !devCommands[cmd] {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Unknown device command %s", cmd), "queueCommand")
+	}
+	now := time.Now().UTC()
+	if cmd == CmdLock || cmd == CmdUnlock {
+		filter := unacked()
+		filter["serial"], filter["cmd"] = serial, bson.M{"$in": []string{CmdLock, CmdUnlock}}
+		if _, err := cmds.UpdateAll(filter, bson.M{"$set": bson.M{"status": "superseded"}}); err != nil {
+			return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to queue device command", "queueCommand/cmds.UpdateAll()")
+		}
+	}
+	dc := &DevCommand{ID: bson.NewObjectId(), Serial: serial, Cmd: cmd, By: by, Status: "pending", Created: now, Expires: now.Add(CommandTTL)}
+	if err := cmds.Insert(dc); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to queue device command", "queueCommand/cmds.Insert()")
+	}
+	if CommandPush != nil {
+		if err := CommandPush(dc); err != nil {
+			// device still gets it on the long-poll
+			log.Warnf("queueCommand: failed to push %s to %s: %s", cmd, serial, err)
+		}
+	}
+	return dc, nil
+}
+
+// pendingCommands : unacknowledged commands for the device, marked delivered as they are sent out
+// delivered commands are sent again till acknowledged, devices are expected to dedupe on the id
+func pendingCommands(cmds *mgo.Collection, serial string) ([]DevCommand, error) {
+	now := time.Now().UTC()
+	filter := unacked()
+	filter["serial"], filter["expires"] = serial, bson.M{"$gt": now}
+	result := []DevCommand{}
+	if err := cmds.Find(filter).Sort("created").All(&result); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device commands", "pendingCommands/cmds.Find().All()")
+	}
+	for i := range result {
+		if result[i].Status == "pending" {
+			cmds.UpdateId(result[i].ID, bson.M{"$set": bson.M{"status": "delivered", "delivered_at": now}})
+			result[i].Status, result[i].DeliveredAt = "delivered", &now
+		}
+	}
+	return result, nil
+}
+
+// HandlDevCommands : devices long-poll for their commands, operators queue commands for the device
+// GET /devices/:serial/commands?wait=30 holds the request till there are commands or the wait runs out, 204 if none
+func HandlDevCommands(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devcmds")
+	cmds := val.(*mgo.Collection)
+	serial := c.Param("serial")
+	if c.Request.Method == "GET" {
+		wait := 0 * time.Second
+		if w := c.Query("wait"); w != "" {
+			secs, err := strconv.Atoi(w)
+			if err != nil || secs < 0 {
+				DigestErr(ex.NewErr(&ex.ErrInvalid{}, err, "Invalid wait, expected seconds", "HandlDevCommands/wait"), c)
+				return
+			}
+			if wait = time.Duration(secs) * time.Second; wait > longPollMax {
+				wait = longPollMax
+			}
+		}
+		deadline := time.Now().Add(wait)
+		extendWriteDeadline(c, wait+streamWrite)
+		if wait > 0 && PollSession != nil {
+			sess := PollSession.Copy()
+			defer sess.Close()
+			cmds = sess.DB(cmds.Database.Name).C(cmds.Name)
+			closeSession.(func())() // not held for the long-poll, closing again on return is harmless
+		}
+		interval := pollFirst
+		for {
+			result, err := pendingCommands(cmds, serial)
+			if DigestErr(err, c) != 0 {
+				return
+			}
+			if len(result) > 0 {
+				c.JSON(http.StatusOK, result)
+				return
+			}
+			if time.Now().After(deadline) {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-draining:
+				// shutting down, the device polls again
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			case <-time.After(interval):
+			}
+			if interval *= 2; interval > pollMax {
+				interval = pollMax
+			}
+		}
+	} else if c.Request.Method == "POST" {
+		val, _ := c.Get("devreg")
+		isReg, err := val.(*auth.DeviceRegColl).IsDeviceRegistered(serial)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if !isReg {
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, nil, "Cannot send commands to an unregistered device", "HandlDevCommands/POST"), c)
+			return
+		}
+		body := struct {
+			Cmd string `json:"cmd"`
+		}{}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read device command, kindly check and send again", "HandlDevCommands/POST"), c)
+			return
+		}
+		dc, err := queueCommand(cmds, serial, body.Cmd, getTknFromCtx(c).User)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		c.JSON(http.StatusOK, dc)
+		return
+	}
+}
+
+// HandlDevCmdAck : device acknowledges the command with the outcome
+// acknowledging rotate-credential sends back the new token, the one used for the ack stops working
+func HandlDevCmdAck(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devcmds")
+	cmds := val.(*mgo.Collection)
+	val, _ = c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	serial, id := c.Param("serial"), c.Param("id")
+	if !bson.IsObjectIdHex(id) {
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid command id", "HandlDevCmdAck"), c)
+		return
+	}
+	ack := struct {
+		Ok     bool   `json:"ok"`
+		Result string `json:"result"`
+	}{}
+	if err := c.ShouldBindJSON(&ack); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read acknowledgement, kindly check and send again", "HandlDevCmdAck"), c)
+		return
+	}
+	dc := &DevCommand{}
+	filter := unacked()
+	filter["_id"], filter["serial"] = bson.ObjectIdHex(id), serial
+	if err := cmds.Find(filter).One(dc); err != nil {
+		if err == mgo.ErrNotFound {
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, err, "No such command awaiting acknowledgement", "HandlDevCmdAck"), c)
+			return
+		}
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device command", "HandlDevCmdAck/cmds.Find().One()"), c)
+		return
+	}
+	status := "acked"
+	if !ack.Ok {
+		status = "failed"
+	}
+	now := time.Now().UTC()
+	if err := cmds.UpdateId(dc.ID, bson.M{"$set": bson.M{"status": status, "result": ack.Result, "acked_at": now}}); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to acknowledge device command", "HandlDevCmdAck/cmds.UpdateId()"), c)
+		return
+	}
+	if dc.Cmd == CmdRotate && ack.Ok {
+		tok, err := newDeviceToken(devreg, serial)
+		if err != nil {
+			DigestErr(ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to issue device token", "HandlDevCmdAck/newDeviceToken"), c)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"token": tok})
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HandlCommands : commands across the devices, ?status=expired&serial= to find devices that arent acknowledging
+// without a status, the commands yet to be acknowledged are listed
+func HandlCommands(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devcmds")
+	cmds := val.(*mgo.Collection)
+	if DigestErr(expireCommands(cmds, time.Now().UTC()), c) != 0 {
+		return
+	}
+	filter := unacked()
+	if s := c.Query("status"); s != "" {
+		filter["status"] = s
+	}
+	if s := c.Query("serial"); s != "" {
+		filter["serial"] = s
+	}
+	result := []DevCommand{}
+	if err := cmds.Find(filter).Sort("-created").Limit(500).All(&result); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device commands", "HandlCommands/cmds.Find().All()"), c)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
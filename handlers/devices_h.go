@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	auth "github.com/eensymachines-in/auth/v2"
 	ex "github.com/eensymachines-in/errx"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // HandlDevice : handles all the requests pertaining to a single device
@@ -21,15 +24,50 @@ func HandlDevice(c *gin.Context) {
 	serial := c.Param("serial")
 	if c.Request.Method == "GET" {
 		// this is when we are trying to get the device registration of a specific device
-		status, err := devregColl.DeviceOfSerial(serial)
-		if ex.DigestErr(err, c) != 0 {
+		var status *auth.DeviceStatus
+		err := traceCall(c, "mongo.DeviceOfSerial", func() (err error) {
+			status, err = devregColl.DeviceOfSerial(serial)
+			return
+		})
+		if DigestErr(err, c) != 0 {
 			return
 		}
 		if *status == (auth.DeviceStatus{}) {
-			ex.DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("No deice with serial: %s found registered", serial), fmt.Sprintf("Failed to get device of serial %s", serial), "HandlDevices/empty devices"), c)
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("No deice with serial: %s found registered", serial), fmt.Sprintf("Failed to get device of serial %s", serial), "HandlDevices/empty devices"), c)
 			return
 		}
-		c.JSON(http.StatusOK, status) // we have the device status, we are 200OK here
+		view := &deviceView{DeviceStatus: status}
+		// enriching the status with the last heartbeat from the device
+		// heartbeats land in the cache first, without it the liveliness is not known and is left out
+		if val, ok := c.Get("cache"); ok {
+			cache := val.(*auth.TokenCache)
+			defer c.MustGet("cache_close").(func())()
+			val, _ = c.Get("devhealth")
+			devhealth := val.(*mgo.Collection)
+			err = traceCall(c, "mongo.lastHeartbeat", func() (err error) {
+				view.Heartbeat, err = lastHeartbeat(cache, devhealth, serial)
+				return
+			})
+			if DigestErr(err, c) != 0 {
+				return
+			}
+			view.Online = view.Heartbeat != nil && time.Since(view.Heartbeat.LastSeen) < HeartbeatTimeout
+		} else {
+			view.LiveUnknown = true
+		}
+		if !ownerOrAdmin(c, status.User) {
+			view.Heartbeat = nil // ip and firmware of the device are for the owner, anyone can see if it is online
+		} else {
+			// name, location and attributes are for the owner, anyone can look up a serial
+			err = traceCall(c, "mongo.deviceMeta", func() (err error) {
+				view.Meta, err = deviceMeta(devregColl, serial)
+				return
+			})
+			if DigestErr(err, c) != 0 {
+				return
+			}
+		}
+		c.JSON(http.StatusOK, view) // we have the device status, we are 200OK here
 		return
 	} else if c.Request.Method == "PATCH" {
 		// modification to device status
@@ -37,51 +75,62 @@ func HandlDevice(c *gin.Context) {
 		black := c.Query("black")
 		if lock != "" {
 			value, err := strconv.ParseBool(lock) // lock param is to be a boolean
-			if ex.DigestErr(err, c) != 0 {
+			if DigestErr(err, c) != 0 {
 				return
 			}
+			action := "unlock"
 			if value {
-				if ex.DigestErr(devregColl.LockDevice(serial), c) != 0 {
-					return
-				}
-			} else {
-				if ex.DigestErr(devregColl.UnLockDevice(serial), c) != 0 {
-					return
-				}
+				action = "lock"
+			}
+			if DigestErr(applyDevAction(devregColl, blcklColl, action, serial, ""), c) != 0 {
+				return
 			}
 		}
 		if black != "" {
 			// when the device needs to be blacklisted or whitelisted
 			value, err := strconv.ParseBool(black) //since the qparam is to be a boolean
 			if err != nil {
-				ex.DigestErr(ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("Patching device: /devices/:serial?black=true is the correct format"), fmt.Sprintf("Black status is invalid, expecting a bool value, got :%v", black), "HandlDevices/PATCH"), c)
+				DigestErr(ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("Patching device: /devices/:serial?black=true is the correct format"), fmt.Sprintf("Black status is invalid, expecting a bool value, got :%v", black), "HandlDevices/PATCH"), c)
 				return
 			}
+			// device needs to be black listed or whitelisted
+			// Even before the device is black listed it has to be removed from the registration
+			action := "white"
 			if value {
-				// device needs to be black listed
-				// Even before the device is black listed it has to be removed from the registration
-				if ex.DigestErr(devregColl.RemoveDeviceReg(serial), c) != 0 {
-					return
-				}
-				if ex.DigestErr(blcklColl.Black(&auth.Blacklist{Serial: serial, Reason: "Test change in the blacklist"}), c) != 0 {
-					return
-				}
-			} else {
-				// the device needs to be whitelisted
-				if ex.DigestErr(blcklColl.White(serial), c) != 0 {
-					return
-				}
+				action = "black"
+			}
+			if DigestErr(applyDevAction(devregColl, blcklColl, action, serial, "Test change in the blacklist"), c) != 0 {
+				return
 			}
 		}
 		c.AbortWithStatus(http.StatusOK)
 		return
 	} else if c.Request.Method == "DELETE" {
-		if ex.DigestErr(devregColl.RemoveDeviceReg(serial), c) != 0 {
+		if DigestErr(devregColl.RemoveDeviceReg(serial), c) != 0 {
 			return
 		}
 	}
 }
 
+// HandlDevToken : issues a fresh token for the device, only the owner of the device or an admin can get one
+// the token the device had till now stops working
+func HandlDevToken(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devreg")
+	devregColl := val.(*auth.DeviceRegColl)
+	serial := c.Param("serial")
+	if ownedDevice(c, devregColl, serial) == nil {
+		return
+	}
+	devTok, err := newDeviceToken(devregColl, serial)
+	if err != nil {
+		DigestErr(ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to issue device token", "HandlDevToken/newDeviceToken"), c)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": devTok})
+}
+
 // HandlDevices : handler for the route /devices
 func HandlDevices(c *gin.Context) {
 	closeSession, _ := c.Get("close_session")
@@ -94,7 +143,7 @@ func HandlDevices(c *gin.Context) {
 	if c.Request.Method == "POST" {
 		devReg := &auth.DeviceReg{}
 		if err := c.ShouldBindJSON(devReg); err != nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrJSONBind{}, fmt.Errorf("handlDevices: Failed to bind device registration from request body %s", err), fmt.Sprintf("Failed to read device registration details, kindly check and send again"), "HandlDevices/PATCH"), c)
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, fmt.Errorf("handlDevices: Failed to bind device registration from request body %s", err), fmt.Sprintf("Failed to read device registration details, kindly check and send again"), "HandlDevices/PATCH"), c)
 			return
 		}
 		// Before we go ahead to register the device, the owner account has to be registered
@@ -102,24 +151,172 @@ func HandlDevices(c *gin.Context) {
 		userReg := col.(*auth.UserAccounts)
 		if !userReg.IsRegistered(devReg.User) {
 			// If the account isnt registered, the device cannot be registered
-			ex.DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("Unable to find the user account registered, %s", devReg.User), "User account isnt registered, cannot register device", "POST/devices"), c)
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("Unable to find the user account registered, %s", devReg.User), "User account isnt registered, cannot register device", "POST/devices"), c)
 			return
 		}
 		// Once we have it confirmed that owner account is registered, we can move ahead to insert the device registration
-		if ex.DigestErr(devregColl.InsertDeviceReg(devReg, blcklColl.Collection), c) != 0 {
+		if DigestErr(devregColl.InsertDeviceReg(devReg, blcklColl.Collection), c) != 0 {
 			return
 		}
-		c.AbortWithStatus(http.StatusOK)
+		Events.Publish(EvDevRegistered, devReg.User, gin.H{"serial": devReg.Serial, "model": devReg.Model, "hw": devReg.Hardware})
+		// the device identifies itself with this token for heartbeats
+		tok, err := newDeviceToken(devregColl, devReg.Serial)
+		if err != nil {
+			DigestErr(ex.NewErr(&ex.ErrEncrypt{}, err, "Device registered, but failed to issue device token", "HandlDevices/newDeviceToken"), c)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"token": tok})
 		return
 	} else if c.Request.Method == "GET" {
 		if c.Query("black") != "" {
 			// when the client code is requesting all the blacklisted devices
 			blacked := []auth.Blacklist{}
-			if ex.DigestErr(blcklColl.Enlist(&blacked), c) != 0 {
+			if DigestErr(blcklColl.Enlist(&blacked), c) != 0 {
 				return
 			}
 			c.JSON(http.StatusOK, blacked)
 			return
 		}
+		filter, err := devListFilter(c)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if c.Query("stats") == "true" {
+			// /devices?stats=true : aggregate counts for the fleet dashboard, filters apply here too
+			stats, err := devFleetStats(devregColl, blcklColl, filter)
+			if DigestErr(err, c) != 0 {
+				return
+			}
+			c.JSON(http.StatusOK, stats)
+			return
+		}
+		// /devices?owner=&hw=&model=&lock=true&from=2021-01-01&to=2021-06-30&sort=-created&limit=20&cursor=
+		pr, err := readPageReq(c, devSortable, "serial")
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		docs, next, total, err := findPage(devregColl.Collection, filter, pr)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		result := make([]deviceListing, len(docs))
+		for i, d := range docs {
+			if err := bsonTo(d, &result[i]); err != nil {
+				DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to read device registrations", "HandlDevices/bsonTo"), c)
+				return
+			}
+			result[i].Registered = result[i].ID.Time()
+		}
+		setPageHeaders(c, next, total)
+		c.JSON(http.StatusOK, result)
+		return
+	}
+}
+
+// deviceListing : device status as sent out in listings, registration time is read off the object id
+type deviceListing struct {
+	auth.DeviceStatus `bson:",inline"`
+	ID                bson.ObjectId `json:"-" bson:"_id"`
+	Registered        time.Time     `json:"registered" bson:"-"`
+	Meta              *DeviceMeta   `json:"meta,omitempty" bson:"meta,omitempty"`
+}
+
+// devSortable : sort keys from the query mapped to the fields in devreg
+var devSortable = map[string]string{"serial": "serial", "owner": "user", "model": "model", "hw": "hw", "created": "_id"}
+
+// devListFilter : reads the filters for enlisting devices
+// from and to are dates (2006-01-02) or RFC3339 times between which the device was registered
+func devListFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+	if owner := c.Query("owner"); owner != "" {
+		filter["user"] = owner
+	}
+	if hw := c.Query("hw"); hw != "" {
+		filter["hw"] = regexQ(hw, true)
+	}
+	if model := c.Query("model"); model != "" {
+		filter["model"] = regexQ(model, true)
+	}
+	if lock := c.Query("lock"); lock != "" {
+		value, err := strconv.ParseBool(lock)
+		if err != nil {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, err, fmt.Sprintf("Lock filter is invalid, expecting a bool value, got :%v", lock), "devListFilter/lock")
+		}
+		filter["lock"] = value
+	}
+	if labels := c.QueryArray("label"); len(labels) > 0 {
+		// ?label=porch&label=outdoor : devices that have all of the labels
+		filter["meta.labels"] = bson.M{"$all": labels}
+	}
+	between := bson.M{}
+	for key, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		val := c.Query(key)
+		if val == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", val); err != nil {
+				return nil, ex.NewErr(&ex.ErrInvalid{}, err, fmt.Sprintf("Invalid date for %s, expected format 2006-01-02", key), "devListFilter/between")
+			}
+			if key == "to" {
+				t = t.AddDate(0, 0, 1) // dates are inclusive of the whole day
+			}
+		}
+		between[op] = bson.NewObjectIdWithTime(t)
+	}
+	if len(between) > 0 {
+		filter["_id"] = between
+	}
+	return filter, nil
+}
+
+// FleetCount : count of devices against one value of the grouping field
+type FleetCount struct {
+	Key    string `json:"key" bson:"_id"`
+	Count  int    `json:"count" bson:"count"`
+	Locked int    `json:"locked" bson:"locked"`
+}
+
+// FleetStats : aggregate counts of the registered devices
+type FleetStats struct {
+	Total   int          `json:"total"`
+	Locked  int          `json:"locked"`
+	Black   int          `json:"blacklisted"` // across the fleet, blacklisted devices are off the registrations and the filter cannot apply
+	ByModel []FleetCount `json:"by_model"`
+	ByOwner []FleetCount `json:"by_owner"`
+}
+
+// devFleetStats : runs the aggregations on the device registrations that match the filter
+// the blacklist has only the serials, so the count of blacklisted devices is for the whole fleet whatever the filter
+func devFleetStats(devreg *auth.DeviceRegColl, blckl *auth.BlacklistColl, filter bson.M) (*FleetStats, error) {
+	stats := &FleetStats{ByModel: []FleetCount{}, ByOwner: []FleetCount{}}
+	var err error
+	if stats.Total, err = devreg.Find(filter).Count(); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device statistics, gateway failed", "devFleetStats/Count")
+	}
+	if stats.Locked, err = devreg.Find(bson.M{"$and": []bson.M{filter, {"lock": true}}}).Count(); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device statistics, gateway failed", "devFleetStats/Count")
+	}
+	if stats.Black, err = blckl.Find(bson.M{}).Count(); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device statistics, gateway failed", "devFleetStats/Count")
+	}
+	groupBy := func(field string, result *[]FleetCount) error {
+		return devreg.Pipe([]bson.M{
+			{"$match": filter},
+			{"$group": bson.M{
+				"_id":    "$" + field,
+				"count":  bson.M{"$sum": 1},
+				"locked": bson.M{"$sum": bson.M{"$cond": []interface{}{"$lock", 1, 0}}},
+			}},
+			{"$sort": bson.M{"count": -1, "_id": 1}},
+		}).All(result)
+	}
+	if err := groupBy("model", &stats.ByModel); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device statistics, gateway failed", "devFleetStats/model")
+	}
+	if err := groupBy("user", &stats.ByOwner); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device statistics, gateway failed", "devFleetStats/user")
 	}
+	return stats, nil
 }
@@ -0,0 +1,204 @@
+package handlers
+
+// Owners can name, tag and describe their devices
+// metadata is stored alongside the registration in devreg under the field meta
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	maxDevLabels   = 20
+	maxDevAttrs    = 32
+	maxDevNameLen  = 64
+	maxDevLocLen   = 128
+	maxDevAttrVLen = 256
+)
+
+var (
+	// labels are lower case so that filtering on them is predictable
+	devLabelRx = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+	devAttrRx  = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,31}$`)
+)
+
+// DeviceMeta : details of the device as given by the owner
+type DeviceMeta struct {
+	Name   string            `json:"name" bson:"name"`     // Porch light controller
+	Labels []string          `json:"labels" bson:"labels"` // tags that the devices can be filtered on
+	Loc    string            `json:"loc" bson:"loc"`
+	Attrs  map[string]string `json:"attrs" bson:"attrs"` // arbitrary key value pairs
+}
+
+// deviceMetaPatch : partial change to the metadata, fields not sent are left as is
+// attributes with null values are removed
+type deviceMetaPatch struct {
+	Name   *string            `json:"name"`
+	Labels *[]string          `json:"labels"`
+	Loc    *string            `json:"loc"`
+	Attrs  map[string]*string `json:"attrs"`
+}
+
+// validate : checks the metadata against the schema
+func (m *DeviceMeta) validate() error {
+	if len(m.Name) > maxDevNameLen {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Device name cannot be more than %d characters", maxDevNameLen), "DeviceMeta.validate/name")
+	}
+	if len(m.Loc) > maxDevLocLen {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Device location cannot be more than %d characters", maxDevLocLen), "DeviceMeta.validate/loc")
+	}
+	if len(m.Labels) > maxDevLabels {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Device cannot have more than %d labels", maxDevLabels), "DeviceMeta.validate/labels")
+	}
+	seen := map[string]bool{}
+	for _, l := range m.Labels {
+		if !devLabelRx.MatchString(l) {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Invalid label %s, labels are lower case alphanumeric with _ . - and upto 32 characters", l), "DeviceMeta.validate/labels")
+		}
+		if seen[l] {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Duplicate label %s", l), "DeviceMeta.validate/labels")
+		}
+		seen[l] = true
+	}
+	if len(m.Attrs) > maxDevAttrs {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Device cannot have more than %d attributes", maxDevAttrs), "DeviceMeta.validate/attrs")
+	}
+	for k, v := range m.Attrs {
+		if !devAttrRx.MatchString(k) {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Invalid attribute %s, attributes are alphanumeric with _ and upto 32 characters", k), "DeviceMeta.validate/attrs")
+		}
+		if len(v) > maxDevAttrVLen {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Attribute %s cannot be more than %d characters", k, maxDevAttrVLen), "DeviceMeta.validate/attrs")
+		}
+	}
+	return nil
+}
+
+// apply : applies the patch over the metadata
+func (p *deviceMetaPatch) apply(m *DeviceMeta) {
+	if p.Name != nil {
+		m.Name = *p.Name
+	}
+	if p.Loc != nil {
+		m.Loc = *p.Loc
+	}
+	if p.Labels != nil {
+		m.Labels = *p.Labels
+	}
+	if m.Attrs == nil {
+		m.Attrs = map[string]string{}
+	}
+	for k, v := range p.Attrs {
+		if v == nil {
+			delete(m.Attrs, k)
+			continue
+		}
+		m.Attrs[k] = *v
+	}
+}
+
+// deviceMeta : reads the metadata of the device, empty metadata when the owner hasnt set any
+func deviceMeta(devreg *auth.DeviceRegColl, serial string) (*DeviceMeta, error) {
+	result := struct {
+		Meta *DeviceMeta `bson:"meta"`
+	}{}
+	if err := devreg.Find(bson.M{"serial": serial}).Select(bson.M{"meta": 1}).One(&result); err != nil && err != mgo.ErrNotFound {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device details", "deviceMeta/devreg.Find().One()")
+	}
+	if result.Meta == nil {
+		return &DeviceMeta{Labels: []string{}, Attrs: map[string]string{}}, nil
+	}
+	return result.Meta, nil
+}
+
+// ownedDevice : gets the device status when the token on the request belongs to the owner of the device or an admin
+// digests the error on the context, status is nil when the request cannot proceed
+func ownedDevice(c *gin.Context, devreg *auth.DeviceRegColl, serial string) *auth.DeviceStatus {
+	status, err := devreg.DeviceOfSerial(serial)
+	if DigestErr(err, c) != 0 {
+		return nil
+	}
+	if *status == (auth.DeviceStatus{}) {
+		DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("No device with serial: %s found registered", serial), fmt.Sprintf("Failed to get device of serial %s", serial), "ownedDevice/empty devices"), c)
+		return nil
+	}
+	tok := getTknFromCtx(c)
+	if tok == nil {
+		return nil
+	}
+	if tok.User != status.User && !tok.HasElevation(2) {
+		DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("%s does not own device %s", tok.User, serial), "Only the owner of the device can do this", "ownedDevice/owner"), c)
+		return nil
+	}
+	return status
+}
+
+// ownerOrAdmin : the request carries the token of the owner (of the device, of the account) or an admin
+// for the routes open to all, unlike ownedDevice it does not digest an error when it does not
+func ownerOrAdmin(c *gin.Context, owner string) bool {
+	val, ok := c.Get("token")
+	if !ok {
+		return false
+	}
+	tok := val.(*auth.JWTok)
+	return tok.User == owner || tok.HasElevation(2)
+}
+
+// HandlDevMeta : owner given name, labels, location and attributes of the device
+// PUT replaces the metadata as a whole while PATCH changes only what is sent
+func HandlDevMeta(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devreg")
+	devregColl := val.(*auth.DeviceRegColl)
+	serial := c.Param("serial")
+	if ownedDevice(c, devregColl, serial) == nil {
+		return
+	}
+	meta := &DeviceMeta{}
+	if c.Request.Method == "GET" {
+		meta, err := deviceMeta(devregColl, serial)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		c.JSON(http.StatusOK, meta)
+		return
+	} else if c.Request.Method == "PUT" {
+		if err := c.ShouldBindJSON(meta); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read device details, kindly check and send again", "HandlDevMeta/PUT"), c)
+			return
+		}
+	} else if c.Request.Method == "PATCH" {
+		patch := &deviceMetaPatch{}
+		if err := c.ShouldBindJSON(patch); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read device details, kindly check and send again", "HandlDevMeta/PATCH"), c)
+			return
+		}
+		var err error
+		if meta, err = deviceMeta(devregColl, serial); DigestErr(err, c) != 0 {
+			return
+		}
+		patch.apply(meta)
+	}
+	if meta.Labels == nil {
+		meta.Labels = []string{}
+	}
+	if meta.Attrs == nil {
+		meta.Attrs = map[string]string{}
+	}
+	if DigestErr(meta.validate(), c) != 0 {
+		return
+	}
+	if err := devregColl.Update(bson.M{"serial": serial}, bson.M{"$set": bson.M{"meta": meta}}); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to update device details, gateway failed", "HandlDevMeta/devregColl.Update()"), c)
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
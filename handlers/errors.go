@@ -0,0 +1,63 @@
+package handlers
+
+// errx has error types for bad requests and for the stores failing, none for the api failing on its own
+// errx also logs the errors it digests on the standard logger, DigestErr here logs them on the request logger instead
+
+import (
+	"fmt"
+	"net/http"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// DigestErr : aborts the request with the error as ex.DigestErr would, sends back 1 when there was an error to digest
+// the error is logged on the request logger so that it carries the request_id and the trace_id
+func DigestErr(err error, c *gin.Context) int {
+	if err == nil {
+		return 0
+	}
+	if x, ok := err.(ex.Errx); ok && x != nil {
+		Logger(c).Error(x.Error())
+		c.AbortWithStatusJSON(x.HTTPStatusCode(), gin.H{"message": x.UserMessage()})
+		return 1
+	}
+	Logger(c).Error(err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	return 1
+}
+
+// ErrInternal : the api failed at something that is neither the request nor the stores - packing a response and the like
+// sent out as 500, implements errx.Errx so that DigestErr takes it like the others
+type ErrInternal struct {
+	UMsg     string
+	Ctx      string
+	InnerErr error
+	uid      string
+}
+
+// newErrInternal : same arguments as ex.NewErr sans the type
+func newErrInternal(e error, m, ct string) *ErrInternal {
+	return &ErrInternal{UMsg: m, Ctx: ct, InnerErr: e, uid: uuid.NewString()[24:]}
+}
+
+// HTTPStatusCode : nothing the client can do about it
+func (e *ErrInternal) HTTPStatusCode() int {
+	return http.StatusInternalServerError
+}
+
+// UserMessage : with the id the user can quote
+func (e *ErrInternal) UserMessage() string {
+	return fmt.Sprintf("%s\n%s", e.UMsg, e.uid)
+}
+
+func (e *ErrInternal) Error() string {
+	return fmt.Sprintf("%s:%s: %s-%s", e.uid, e.Ctx, e.UMsg, e.InnerErr)
+}
+
+// Log : logs the error
+func (e *ErrInternal) Log() {
+	log.Error(e.Error())
+}
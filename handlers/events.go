@@ -0,0 +1,123 @@
+package handlers
+
+// Events on accounts and devices that other services would want to know of
+// handlers publish on the bus, the bus fans them out to whoever has subscribed
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	EvUserCreated    = "user.created"
+	EvUserDeleted    = "user.deleted"
+	EvDevRegistered  = "device.registered"
+	EvDevLocked      = "device.locked"
+	EvDevUnlocked    = "device.unlocked"
+	EvDevBlacklisted = "device.blacklisted"
+	EvDevWhitelisted = "device.whitelisted"
+	EvLoginFailed    = "login.failed"
+	EvTokenReused    = "token.reused" // refresh token presented a second time, the session is revoked
+	evAny            = "*"
+)
+
+// eventKinds : all the events that can be subscribed to
+var eventKinds = map[string]bool{
+	EvUserCreated: true, EvUserDeleted: true, EvDevRegistered: true, EvDevLocked: true, EvDevUnlocked: true,
+	EvDevBlacklisted: true, EvDevWhitelisted: true, EvLoginFailed: true, EvTokenReused: true, evAny: true,
+}
+
+// Event : one thing that happened to an account or a device
+type Event struct {
+	ID    string      `json:"id" bson:"id"`
+	Kind  string      `json:"event" bson:"event"`
+	At    time.Time   `json:"at" bson:"at"`
+	Owner string      `json:"owner,omitempty" bson:"owner,omitempty"` // account that the event concerns
+	Data  interface{} `json:"data" bson:"data"`
+}
+
+// EventBus : events published by the handlers are fanned out from here
+// publishing only queues the event, fanning out is done off the request by the bus
+type EventBus struct {
+	session *mgo.Session  // webhook subscriptions and the delivery queue
+	cache   *redis.Client // live streams subscribe to the events on redis
+	queue   chan *Event
+	mu      sync.RWMutex // closed is read on publishing, set on closing
+	closed  bool
+	done    chan struct{}
+}
+
+// evQueueLen : events waiting to be fanned out, publishing beyond this fans out on the request instead
+const evQueueLen = 1024
+
+// Events : bus that the handlers publish on, set up by main
+// when nil the events are dropped
+var Events *EventBus
+
+// NewEventBus : bus that enqueues the events for webhook delivery and publishes them for the live streams
+// Close the bus before the session and the cache
+func NewEventBus(session *mgo.Session, cache *redis.Client) *EventBus {
+	eb := &EventBus{session: session, cache: cache, queue: make(chan *Event, evQueueLen), done: make(chan struct{})}
+	go func() {
+		defer close(eb.done)
+		for ev := range eb.queue {
+			eb.fanOut(ev)
+		}
+	}()
+	return eb
+}
+
+// Publish : sends out the event, errors are logged since the action that raised the event has already happened
+func (eb *EventBus) Publish(kind, owner string, data interface{}) {
+	if eb == nil {
+		return
+	}
+	ev := &Event{ID: uuid.New().String(), Kind: kind, At: time.Now().UTC(), Owner: owner, Data: data}
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	if eb.closed {
+		log.Warnf("EventBus.Publish: bus closed, dropped %s", kind)
+		return
+	}
+	select {
+	case eb.queue <- ev:
+	default:
+		// backed up, better slow than lost
+		eb.fanOut(ev)
+	}
+}
+
+// Close : fans out the events queued so far, events published after are dropped
+func (eb *EventBus) Close() {
+	if eb == nil {
+		return
+	}
+	eb.mu.Lock()
+	if !eb.closed {
+		eb.closed = true
+		close(eb.queue)
+	}
+	eb.mu.Unlock()
+	<-eb.done
+}
+
+// fanOut : publishes the event for the live streams and queues it for the webhooks
+func (eb *EventBus) fanOut(ev *Event) {
+	if body, err := json.Marshal(ev); err != nil {
+		log.Errorf("EventBus.fanOut: failed to marshal event %s: %s", ev.Kind, err)
+	} else if err := eb.cache.Publish(evChannel, body).Err(); err != nil {
+		log.Errorf("EventBus.fanOut: failed to publish %s to the live streams: %s", ev.Kind, err)
+	}
+	sess := eb.session.Copy()
+	defer sess.Close()
+	db := sess.DB("autolumin")
+	if err := enqueueDeliveries(db.C("webhooks"), db.C("whdeliveries"), ev); err != nil {
+		log.Errorf("EventBus.fanOut: failed to enqueue webhook deliveries for %s: %s", ev.Kind, err)
+	}
+}
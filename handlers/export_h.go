@@ -0,0 +1,190 @@
+package handlers
+
+// Personal data export and erasure of user accounts
+// export sends out all what we store against an account as one zip archive
+// erasure anonymises the records that we need to keep for the device audit trail
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UserDataExport : shape of the archive that the user gets to download
+// every section that is stored against the account has its place here
+type UserDataExport struct {
+	ExportedAt time.Time            `json:"exported_at"`
+	Account    *auth.UserAccDetails `json:"account"`
+	Devices    []exportDevice       `json:"devices"`  // with the details the owner gave them and their last heartbeat
+	Sessions   []*Session           `json:"sessions"` // live logins, with the client ip and user agent
+	Audit      []AuditEntry         `json:"audit"`    // actions by or on the account
+}
+
+// exportDevice : device of the account as it goes in the archive
+type exportDevice struct {
+	auth.DeviceStatus
+	Meta      *DeviceMeta   `json:"meta"`
+	Heartbeat *DevHeartbeat `json:"heartbeat,omitempty"` // nil when the device hasnt sent one
+}
+
+// exportDevices : devices of the account along with their metadata and last heartbeat
+func exportDevices(devreg *auth.DeviceRegColl, cache *auth.TokenCache, devhealth *mgo.Collection, email string) ([]exportDevice, error) {
+	devices, err := devreg.FindUserDevices(email)
+	if err != nil {
+		return nil, err
+	}
+	result := []exportDevice{}
+	for _, d := range devices {
+		meta, err := deviceMeta(devreg, d.Serial)
+		if err != nil {
+			return nil, err
+		}
+		hb, err := lastHeartbeat(cache, devhealth, d.Serial)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exportDevice{DeviceStatus: d, Meta: meta, Heartbeat: hb})
+	}
+	return result, nil
+}
+
+// pseudonym : stable anonymous identifier for an email
+// the same email always gives the same pseudonym so that the retained records can still be correlated to each other
+// it is of the keyed hash that the audit trail keeps, so the trail can tell it was erasure that put it in place of the email
+func pseudonym(email string) string {
+	return pseudonymOf(auditValHash(email))
+}
+
+// pseudonymOf : pseudonym for the keyed hash of the email
+func pseudonymOf(valHash string) string {
+	if len(valHash) < 16 {
+		return ""
+	}
+	return fmt.Sprintf("erased-%s", valHash[:16])
+}
+
+// zipExport : packs the export as json inside a zip archive
+func zipExport(export *UserDataExport) ([]byte, error) {
+	body, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, newErrInternal(err, "Failed to prepare account data export", "zipExport/json.MarshalIndent")
+	}
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	f, err := zw.Create("export.json")
+	if err != nil {
+		return nil, newErrInternal(err, "Failed to prepare account data export", "zipExport/zw.Create")
+	}
+	if _, err := f.Write(body); err != nil {
+		return nil, newErrInternal(err, "Failed to prepare account data export", "zipExport/f.Write")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, newErrInternal(err, "Failed to prepare account data export", "zipExport/zw.Close")
+	}
+	return buf.Bytes(), nil
+}
+
+// HandlUsrExport : sends out a machine readable archive of all the data stored against the account
+func HandlUsrExport(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("userreg")
+	ua := val.(*auth.UserAccounts)
+	val, _ = c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	email := c.Param("email")
+	cache, cacClose := getTknCacFromCtx(c)
+	if cache == nil {
+		return
+	}
+	defer cacClose()
+
+	details, err := ua.AccountDetails(email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	val, _ = c.Get("devhealth")
+	devices, err := exportDevices(devreg, cache, val.(*mgo.Collection), email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	val, _ = c.Get("audit")
+	trail, err := userAudit(val.(*mgo.Collection), email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	sessions, err := userSessions(cache, email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	archive, err := zipExport(&UserDataExport{ExportedAt: time.Now().UTC(), Account: details, Devices: devices, Sessions: sessions, Audit: trail})
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", pseudonym(email)))
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// erasureUpdate : change erasure makes in a collection, the records are kept but the personal data in them goes
+type erasureUpdate struct {
+	coll     string
+	selector bson.M
+	update   bson.M
+}
+
+// erasureUpdates : what erasure changes outside the account and the audit trail
+func erasureUpdates(email string) []erasureUpdate {
+	anon := pseudonym(email)
+	return []erasureUpdate{
+		// registrations are handed over to the pseudonym, the name, location and attributes the owner gave go along with the email
+		{"devreg", bson.M{"user": email}, bson.M{"$set": bson.M{"user": anon, "lock": true}, "$unset": bson.M{"meta": ""}}},
+		// events on the account carry the email, name and ip in the payload
+		{"whdeliveries", bson.M{"event.owner": email}, bson.M{"$set": bson.M{"event.owner": anon, "event.data": bson.M{"erased": true}}}},
+		{"bulkjobs", bson.M{"by": email}, bson.M{"$set": bson.M{"by": anon}}},
+		{"devcmds", bson.M{"by": email}, bson.M{"$set": bson.M{"by": anon}}},
+	}
+}
+
+// eraseAccount : removes the personal data of the account while retaining the device trail
+// devices are locked, blacklisted and their registrations are handed over to the pseudonym of the owner
+// records elsewhere that name the account are kept under the pseudonym, see erasureUpdates
+func eraseAccount(c *gin.Context, ua *auth.UserAccounts, email string) error {
+	val, _ := c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	val, _ = c.Get("devblacklist")
+	blckL := val.(*auth.BlacklistColl)
+	devices, err := devreg.FindUserDevices(email)
+	if err != nil {
+		return err
+	}
+	anon := pseudonym(email)
+	for _, d := range devices {
+		if err := blckL.Black(&auth.Blacklist{Serial: d.Serial, Reason: fmt.Sprintf("Account erased, device is blacklisted (%s)", anon)}); err != nil {
+			return err
+		}
+	}
+	for _, eu := range erasureUpdates(email) {
+		coll := devreg.Collection
+		if eu.coll != "devreg" {
+			val, _ = c.Get(eu.coll)
+			coll = val.(*mgo.Collection)
+		}
+		if _, err := coll.UpdateAll(eu.selector, eu.update); err != nil {
+			return ex.NewErr(&ex.ErrQuery{}, err, "Failed to anonymise records of the account", fmt.Sprintf("eraseAccount/%s.UpdateAll", eu.coll))
+		}
+	}
+	val, _ = c.Get("audit")
+	if err := pseudonymiseAudit(val.(*mgo.Collection), email); err != nil {
+		return err
+	}
+	return ua.RemoveAccount(email)
+}
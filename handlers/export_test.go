@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// docField : value at the dotted path of the document
+func docField(doc bson.M, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		sub, ok := doc[k].(bson.M)
+		if !ok {
+			return nil, false
+		}
+		doc = sub
+	}
+	val, ok := doc[keys[len(keys)-1]]
+	return val, ok
+}
+
+// docParent : document that holds the last key of the dotted path
+func docParent(doc bson.M, path string) (bson.M, string) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		doc = doc[k].(bson.M)
+	}
+	return doc, keys[len(keys)-1]
+}
+
+// applyErasure : runs the update on the documents the selector matches, $set and $unset are all erasure uses
+func applyErasure(eu erasureUpdate, docs []bson.M) {
+	for _, doc := range docs {
+		matched := true
+		for path, want := range eu.selector {
+			if val, ok := docField(doc, path); !ok || val != want {
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+		if set, ok := eu.update["$set"].(bson.M); ok {
+			for path, val := range set {
+				parent, k := docParent(doc, path)
+				parent[k] = val
+			}
+		}
+		if unset, ok := eu.update["$unset"].(bson.M); ok {
+			for path := range unset {
+				parent, k := docParent(doc, path)
+				delete(parent, k)
+			}
+		}
+	}
+}
+
+// TestErasureUpdates : personal data of the account is gone from every collection erasure touches, records of others are left as they were
+func TestErasureUpdates(t *testing.T) {
+	defer os.Setenv("HASH_SECRET", os.Getenv("HASH_SECRET"))
+	os.Setenv("HASH_SECRET", "k3y")
+	email, other := "someone@gmail.com", "other@gmail.com"
+	colls := map[string][]bson.M{
+		"devreg": {
+			{"user": email, "serial": "000000007920365b", "lock": false, "meta": bson.M{"name": "Porch light of Someone Kumar", "loc": "12 Baker street", "attrs": bson.M{"phone": "9822012345"}}},
+			{"user": other, "serial": "00000000a3e1f2c4", "lock": false, "meta": bson.M{"name": "Garage"}},
+		},
+		"whdeliveries": {
+			{"status": "delivered", "event": bson.M{"event": EvUserCreated, "owner": email, "data": bson.M{"email": email, "name": "Someone Kumar"}}},
+			{"status": "pending", "event": bson.M{"event": EvLoginFailed, "owner": email, "data": bson.M{"email": email, "ip": "203.0.113.7"}}},
+			{"status": "pending", "event": bson.M{"event": EvLoginFailed, "owner": other, "data": bson.M{"email": other, "ip": "198.51.100.2"}}},
+		},
+		"bulkjobs": {{"action": "lock", "by": email}, {"action": "unlock", "by": other}},
+		"devcmds":  {{"cmd": "reboot", "by": email}, {"cmd": "reboot", "by": other}},
+	}
+	updates := erasureUpdates(email)
+	for _, eu := range updates {
+		docs, ok := colls[eu.coll]
+		assert.True(t, ok, "erasure updates %s", eu.coll)
+		applyErasure(eu, docs)
+	}
+	for coll := range colls {
+		found := false
+		for _, eu := range updates {
+			found = found || eu.coll == coll
+		}
+		assert.True(t, found, "%s is left out of erasure", coll)
+	}
+	for coll, docs := range colls {
+		body, _ := json.Marshal(docs)
+		for _, personal := range []string{email, "Someone Kumar", "Baker street", "9822012345", "203.0.113.7"} {
+			assert.NotContains(t, string(body), personal, "%s still has personal data", coll)
+		}
+		assert.Contains(t, string(body), other, "%s records of others are kept", coll)
+	}
+	assert.Equal(t, pseudonym(email), colls["devreg"][0]["user"])
+	assert.Equal(t, true, colls["devreg"][0]["lock"])
+	assert.Equal(t, pseudonym(email), colls["bulkjobs"][0]["by"])
+	assert.Equal(t, pseudonym(email), colls["devcmds"][0]["by"])
+	assert.Equal(t, bson.M{"name": "Garage"}, colls["devreg"][1]["meta"])
+	assert.Equal(t, "198.51.100.2", colls["whdeliveries"][2]["event"].(bson.M)["data"].(bson.M)["ip"])
+}
@@ -0,0 +1,360 @@
+package handlers
+
+// Device groups let operators act on many devices at once
+// a group is either a static list of serials or a query on owner/model/labels that is resolved when used
+// bulk actions run in the request for small sets and as a tracked job in the background for larger ones
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BulkSyncMax : bulk actions on more devices than this run as a background job
+var BulkSyncMax = 50
+
+// GroupQuery : devices picked dynamically, empty fields are not filtered on
+type GroupQuery struct {
+	Owner  string   `json:"owner,omitempty" bson:"owner,omitempty"`
+	Model  string   `json:"model,omitempty" bson:"model,omitempty"`
+	Labels []string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// filter : mongo filter on devreg
+func (gq *GroupQuery) filter() bson.M {
+	f := bson.M{}
+	if gq.Owner != "" {
+		f["user"] = gq.Owner
+	}
+	if gq.Model != "" {
+		f["model"] = regexQ(gq.Model, true)
+	}
+	if len(gq.Labels) > 0 {
+		f["meta.labels"] = bson.M{"$all": gq.Labels}
+	}
+	return f
+}
+
+// DeviceGroup : named set of devices, either static serials or a dynamic query
+type DeviceGroup struct {
+	Name    string      `json:"name" bson:"name"`
+	Serials []string    `json:"serials,omitempty" bson:"serials,omitempty"`
+	Query   *GroupQuery `json:"query,omitempty" bson:"query,omitempty"`
+	Created time.Time   `json:"created" bson:"created"`
+}
+
+// validate : group has a valid name and is either static or dynamic but not both
+func (g *DeviceGroup) validate() error {
+	if !devLabelRx.MatchString(g.Name) {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid group name, names are lower case alphanumeric with _ . - and upto 32 characters", "DeviceGroup.validate/name")
+	}
+	if (len(g.Serials) == 0) == (g.Query == nil) {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Group has to have either a list of serials or a query", "DeviceGroup.validate")
+	}
+	if g.Query != nil && len(g.Query.filter()) == 0 {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Group query has to filter on at least one of owner, model or labels", "DeviceGroup.validate/query")
+	}
+	return nil
+}
+
+// ResolveGroup : serials of the devices in the group as of now
+func ResolveGroup(devreg *auth.DeviceRegColl, g *DeviceGroup) ([]string, error) {
+	if g.Query == nil {
+		return g.Serials, nil
+	}
+	serials := []string{}
+	if err := devreg.Find(g.Query.filter()).Distinct("serial", &serials); err != nil {
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get devices in the group", "ResolveGroup/devreg.Find().Distinct()")
+	}
+	return serials, nil
+}
+
+// findGroup : gets the group of the name, ErrNotFound when there isnt one
+func findGroup(coll *mgo.Collection, name string) (*DeviceGroup, error) {
+	g := &DeviceGroup{}
+	if err := coll.Find(bson.M{"name": name}).One(g); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ex.NewErr(&ex.ErrNotFound{}, err, fmt.Sprintf("No device group %s", name), "findGroup")
+		}
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device group", "findGroup/coll.Find().One()")
+	}
+	return g, nil
+}
+
+// applyDevAction : applies lock/unlock/black/white on a single device
+// blacklisting removes the registration before the device is blacklisted
+// events are published only for the actions that went through
+func applyDevAction(devreg *auth.DeviceRegColl, blckl *auth.BlacklistColl, action, serial, reason string) error {
+	owner := ""
+	if status, err := devreg.DeviceOfSerial(serial); err == nil {
+		owner = status.User
+	}
+	var err error
+	var kind string
+	switch action {
+	case "lock":
+		err, kind = devreg.LockDevice(serial), EvDevLocked
+	case "unlock":
+		err, kind = devreg.UnLockDevice(serial), EvDevUnlocked
+	case "black":
+		if err = devreg.RemoveDeviceReg(serial); err == nil {
+			err = blckl.Black(&auth.Blacklist{Serial: serial, Reason: reason})
+		}
+		kind = EvDevBlacklisted
+	case "white":
+		err, kind = blckl.White(serial), EvDevWhitelisted
+	default:
+		return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Unknown device action %s", action), "applyDevAction")
+	}
+	if err != nil {
+		return err
+	}
+	if action == CmdLock || action == CmdUnlock {
+		// device is told right away instead of waiting for it to poll its status
+		if _, err := queueCommand(devreg.Database.C("devcmds"), serial, action, ""); err != nil {
+			log.Errorf("applyDevAction: failed to queue %s for %s: %s", action, serial, err)
+		}
+	}
+	Events.Publish(kind, owner, gin.H{"serial": serial, "reason": reason})
+	return nil
+}
+
+// BulkResult : outcome of the bulk action on one device
+type BulkResult struct {
+	Serial string `json:"serial" bson:"serial"`
+	Ok     bool   `json:"ok" bson:"ok"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// BulkJob : bulk action running in the background
+type BulkJob struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	Action   string        `json:"action" bson:"action"`
+	By       string        `json:"by" bson:"by"`         // user that requested the action
+	Status   string        `json:"status" bson:"status"` // running / done / interrupted
+	Total    int           `json:"total" bson:"total"`
+	Done     int           `json:"done" bson:"done"`
+	Failed   int           `json:"failed" bson:"failed"`
+	Results  []BulkResult  `json:"results" bson:"results"`
+	Created  time.Time     `json:"created" bson:"created"`
+	Finished *time.Time    `json:"finished,omitempty" bson:"finished,omitempty"`
+}
+
+// bulkReq : the bulk action and the devices it is to be applied on
+type bulkReq struct {
+	Action  string   `json:"action"` // lock / unlock / black / white
+	Group   string   `json:"group"`
+	Serials []string `json:"serials"`
+	Reason  string   `json:"reason"`
+}
+
+// bulkAct : applies the action on one device, errors are recorded and not returned
+func bulkAct(devreg *auth.DeviceRegColl, blckl *auth.BlacklistColl, req *bulkReq, serial string) BulkResult {
+	if err := applyDevAction(devreg, blckl, req.Action, serial, req.Reason); err != nil {
+		msg := err.Error()
+		if x, ok := err.(ex.Errx); ok {
+			msg = x.UserMessage()
+		}
+		return BulkResult{Serial: serial, Ok: false, Error: msg}
+	}
+	return BulkResult{Serial: serial, Ok: true}
+}
+
+// runBulkJob : applies the action on all the devices while updating the progress on the job
+// the server shutting down stops the job before the next device, the devices done so far are on the job
+func runBulkJob(devreg *auth.DeviceRegColl, blckl *auth.BlacklistColl, jobs *mgo.Collection, job *BulkJob, req *bulkReq, serials []string) {
+	for _, s := range serials {
+		select {
+		case <-bulkStop:
+			jobs.UpdateId(job.ID, bson.M{"$set": bson.M{"status": "interrupted", "finished": time.Now().UTC()}})
+			return
+		default:
+		}
+		res := bulkAct(devreg, blckl, req, s)
+		inc := bson.M{"done": 1}
+		if !res.Ok {
+			inc["failed"] = 1
+		}
+		jobs.UpdateId(job.ID, bson.M{"$push": bson.M{"results": res}, "$inc": inc})
+	}
+	jobs.UpdateId(job.ID, bson.M{"$set": bson.M{"status": "done", "finished": time.Now().UTC()}})
+}
+
+// HandlGroups : enlisting and creating device groups
+func HandlGroups(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devgroups")
+	groups := val.(*mgo.Collection)
+	if c.Request.Method == "GET" {
+		result := []DeviceGroup{}
+		if err := groups.Find(bson.M{}).Sort("name").All(&result); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get device groups", "HandlGroups/GET"), c)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	} else if c.Request.Method == "POST" {
+		g := &DeviceGroup{}
+		if err := c.ShouldBindJSON(g); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read device group, kindly check and send again", "HandlGroups/POST"), c)
+			return
+		}
+		if DigestErr(g.validate(), c) != 0 {
+			return
+		}
+		if n, _ := groups.Find(bson.M{"name": g.Name}).Count(); n > 0 {
+			DigestErr(ex.NewErr(&ex.ErrDuplicate{}, nil, fmt.Sprintf("Device group %s already exists", g.Name), "HandlGroups/POST"), c)
+			return
+		}
+		g.Created = time.Now().UTC()
+		if err := groups.Insert(g); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to create device group", "HandlGroups/groups.Insert()"), c)
+			return
+		}
+		c.JSON(http.StatusOK, g)
+		return
+	}
+}
+
+// HandlGroup : a single device group, GET sends the group with its current members
+func HandlGroup(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devgroups")
+	groups := val.(*mgo.Collection)
+	val, _ = c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	name := c.Param("name")
+	g, err := findGroup(groups, name)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	if c.Request.Method == "GET" {
+		members, err := ResolveGroup(devreg, g)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"group": g, "members": members})
+		return
+	} else if c.Request.Method == "PUT" {
+		newG := &DeviceGroup{}
+		if err := c.ShouldBindJSON(newG); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read device group, kindly check and send again", "HandlGroup/PUT"), c)
+			return
+		}
+		newG.Name, newG.Created = g.Name, g.Created // name is the identity of the group and cannot change
+		if DigestErr(newG.validate(), c) != 0 {
+			return
+		}
+		if err := groups.Update(bson.M{"name": name}, newG); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to update device group", "HandlGroup/groups.Update()"), c)
+			return
+		}
+		c.JSON(http.StatusOK, newG)
+		return
+	} else if c.Request.Method == "DELETE" {
+		if err := groups.Remove(bson.M{"name": name}); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to remove device group", "HandlGroup/groups.Remove()"), c)
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+}
+
+// HandlBulk : applies lock/unlock/black/white on a group or a list of serials
+// small sets get the per device results right away, larger sets get 202 with the job to follow up on
+func HandlBulk(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	val, _ = c.Get("devblacklist")
+	blckl := val.(*auth.BlacklistColl)
+	val, _ = c.Get("bulkjobs")
+	jobs := val.(*mgo.Collection)
+
+	if c.Request.Method == "GET" {
+		// /bulk/:id getting the progress of the job
+		id := c.Param("id")
+		if !bson.IsObjectIdHex(id) {
+			DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid bulk job id", "HandlBulk/GET"), c)
+			return
+		}
+		job := &BulkJob{}
+		if err := jobs.FindId(bson.ObjectIdHex(id)).One(job); err != nil {
+			if err == mgo.ErrNotFound {
+				DigestErr(ex.NewErr(&ex.ErrNotFound{}, err, "No such bulk job", "HandlBulk/GET"), c)
+				return
+			}
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get bulk job", "HandlBulk/jobs.FindId()"), c)
+			return
+		}
+		c.JSON(http.StatusOK, job)
+		return
+	}
+	req := &bulkReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read bulk action, kindly check and send again", "HandlBulk/POST"), c)
+		return
+	}
+	switch req.Action {
+	case "lock", "unlock", "black", "white":
+	default:
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Unknown action %s, expected lock/unlock/black/white", req.Action), "HandlBulk/POST"), c)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "Blacklisted in bulk"
+	}
+	serials := req.Serials
+	if req.Group != "" {
+		val, _ = c.Get("devgroups")
+		g, err := findGroup(val.(*mgo.Collection), req.Group)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if serials, err = ResolveGroup(devreg, g); DigestErr(err, c) != 0 {
+			return
+		}
+	}
+	if len(serials) == 0 {
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "No devices to act on, send either a group or serials", "HandlBulk/POST"), c)
+		return
+	}
+	if len(serials) <= BulkSyncMax {
+		results := make([]BulkResult, len(serials))
+		for i, s := range serials {
+			results[i] = bulkAct(devreg, blckl, req, s)
+		}
+		c.JSON(http.StatusOK, results)
+		return
+	}
+	// +++++++++++ large sets run in the background on a session of their own
+	by := ""
+	if tok := getTknFromCtx(c); tok != nil {
+		by = tok.User
+	}
+	job := &BulkJob{ID: bson.NewObjectId(), Action: req.Action, By: by, Status: "running", Total: len(serials), Results: []BulkResult{}, Created: time.Now().UTC()}
+	if err := jobs.Insert(job); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to start bulk job", "HandlBulk/jobs.Insert()"), c)
+		return
+	}
+	sess := devreg.Database.Session.Copy()
+	bulkJobs.Add(1) // shutdown waits on the job
+	go func() {
+		defer bulkJobs.Done()
+		defer sess.Close()
+		runBulkJob(&auth.DeviceRegColl{Collection: devreg.With(sess)}, &auth.BlacklistColl{Collection: blckl.With(sess)}, jobs.With(sess), job, req, serials)
+	}()
+	c.Header("Location", fmt.Sprintf("/bulk/%s", job.ID.Hex()))
+	c.JSON(http.StatusAccepted, job)
+}
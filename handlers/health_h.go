@@ -0,0 +1,155 @@
+package handlers
+
+// Health endpoints for the orchestrator
+// liveness only says the process is serving, readiness checks each of the dependencies the api cannot work without
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// Version, Commit, BuildTime : build info, set at build time
+	// go build -ldflags "-X github.com/eensymachines-in/authapi/handlers.Version=v1.2.0 -X github.com/eensymachines-in/authapi/handlers.Commit=$(git rev-parse --short HEAD)"
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+	// ReadyChecks : dependencies checked on /readyz, set up by main
+	ReadyChecks []HealthCheck
+	// ReadyTimeout : a check that takes longer than this has failed
+	ReadyTimeout = 3 * time.Second
+	// ReadyCacheTTL : probes within this of the last run get the same reports, the dependencies are not hit on every probe
+	ReadyCacheTTL = 5 * time.Second
+	started       = time.Now()
+	ready         readyCache
+)
+
+// readyCache : reports of the last run of the checks
+// the lock is held through a run so that probes coming in together wait on the one run
+type readyCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	reports []CheckReport
+	ok      bool
+}
+
+// get : reports of the checks, run again when older than the ttl
+func (rc *readyCache) get(checks []HealthCheck) ([]CheckReport, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.reports == nil || time.Since(rc.at) >= ReadyCacheTTL {
+		rc.reports, rc.ok = runChecks(checks, ReadyTimeout)
+		rc.at = time.Now()
+	}
+	return rc.reports, rc.ok
+}
+
+// reset : next probe runs the checks
+func (rc *readyCache) reset() {
+	rc.mu.Lock()
+	rc.reports = nil
+	rc.mu.Unlock()
+}
+
+// HealthCheck : named check on one dependency, nil error is healthy
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// CheckReport : outcome of one check as it is sent out
+type CheckReport struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"` // ok, fail
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// runChecks : runs all the checks together, each is given the timeout
+// reports are in the same order as the checks
+func runChecks(checks []HealthCheck, timeout time.Duration) ([]CheckReport, bool) {
+	reports := make([]CheckReport, len(checks))
+	var wg sync.WaitGroup
+	for i, hc := range checks {
+		wg.Add(1)
+		go func(i int, hc HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1) // buffered so that a check that hangs does not leak when abandoned
+			go func() { done <- hc.Check() }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(timeout):
+				err = fmt.Errorf("timed out after %s", timeout)
+			}
+			reports[i] = CheckReport{Name: hc.Name, Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				reports[i].Status = "fail"
+				reports[i].Error = err.Error()
+			}
+		}(i, hc)
+	}
+	wg.Wait()
+	for _, r := range reports {
+		if r.Status != "ok" {
+			return reports, false
+		}
+	}
+	return reports, true
+}
+
+// HandlHealthz : liveness, the process is up and serving requests
+// does not touch the dependencies, an orchestrator would otherwise restart the api for the database being down
+func HandlHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"uptime": time.Since(started).Round(time.Second).String(),
+	})
+}
+
+// HandlReadyz : readiness, 503 when any of the dependencies fail so that the api is taken out of the load balancer
+// this is on the public listener, which check failed is sent out but not the error - that is on HandlReadyzDetail
+func HandlReadyz(c *gin.Context) {
+	readyz(c, false)
+}
+
+// HandlReadyzDetail : readiness with the errors of the checks that failed, for the internal listener
+func HandlReadyzDetail(c *gin.Context) {
+	readyz(c, true)
+}
+
+func readyz(c *gin.Context, detail bool) {
+	reports, ok := ready.get(ReadyChecks)
+	if !detail {
+		public := make([]CheckReport, len(reports))
+		for i, r := range reports {
+			r.Error = ""
+			public[i] = r
+		}
+		reports = public
+	}
+	status, code := "ok", http.StatusOK
+	if !ok {
+		status, code = "fail", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": reports,
+	})
+}
+
+// HandlVersion : build info of the running api
+func HandlVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":    Version,
+		"commit":     Commit,
+		"build_time": BuildTime,
+		"go":         runtime.Version(),
+	})
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/readyz", HandlReadyz)
+	r.GET("/internal/readyz", HandlReadyzDetail)
+	probe := func(path ...string) (int, map[string]interface{}) {
+		url := "/readyz"
+		if len(path) > 0 {
+			url = path[0]
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		body := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+	defer func(checks []HealthCheck, timeout, ttl time.Duration) {
+		ReadyChecks, ReadyTimeout, ReadyCacheTTL = checks, timeout, ttl
+		ready.reset()
+	}(ReadyChecks, ReadyTimeout, ReadyCacheTTL)
+	ready.reset()
+
+	ReadyChecks = []HealthCheck{
+		{Name: "mongo", Check: func() error { return nil }},
+		{Name: "redis", Check: func() error { return nil }},
+	}
+	code, body := probe()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+	assert.Len(t, body["checks"], 2)
+
+	// probes within the ttl get the reports of the last run
+	runs := 0
+	ReadyChecks = []HealthCheck{{Name: "mongo", Check: func() error { runs++; return nil }}}
+	ready.reset()
+	probe()
+	probe()
+	assert.Equal(t, 1, runs, "Checks run again within the ttl")
+	ReadyCacheTTL = 0
+
+	// one failing and one hanging dependency, the report is still in the order of the checks
+	ReadyTimeout = 100 * time.Millisecond
+	ReadyChecks = []HealthCheck{
+		{Name: "mongo", Check: func() error { return fmt.Errorf("no reachable servers") }},
+		{Name: "redis", Check: func() error { time.Sleep(time.Second); return nil }},
+		{Name: "secrets", Check: func() error { return nil }},
+	}
+	start := time.Now()
+	code, body = probe()
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "Hanging check should not hold up the probe")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "fail", body["status"])
+	checks := body["checks"].([]interface{})
+	assert.Equal(t, "fail", checks[0].(map[string]interface{})["status"])
+	assert.NotContains(t, checks[0].(map[string]interface{}), "error", "Errors on the public probe")
+	assert.Equal(t, "ok", checks[2].(map[string]interface{})["status"])
+
+	// the internal probe has the errors
+	code, body = probe("/internal/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	checks = body["checks"].([]interface{})
+	assert.Equal(t, "no reachable servers", checks[0].(map[string]interface{})["error"])
+	assert.Contains(t, checks[1].(map[string]interface{})["error"], "timed out")
+	assert.Equal(t, "ok", checks[2].(map[string]interface{})["status"])
+}
@@ -0,0 +1,193 @@
+package handlers
+
+// Devices send in heartbeats to say they are alive
+// heartbeats land in the cache first and are flushed to the database periodically
+// the device status is then enriched with online/offline computed off the last seen time
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// HeartbeatTimeout : device not heard from since this duration is considered offline
+	HeartbeatTimeout = 2 * time.Minute
+	// DeviceTokExp : devices are issued tokens that live this long, unless Tokens has the lifetime set
+	DeviceTokExp = 365 * 24 * time.Hour
+)
+
+const (
+	hbDirtySet = "devhb:dirty" // serials of the devices with heartbeats yet to be flushed
+)
+
+// DevHeartbeat : last heartbeat from the device
+type DevHeartbeat struct {
+	Serial   string    `json:"-" bson:"serial"`
+	LastSeen time.Time `json:"lastseen" bson:"lastseen"`
+	IP       string    `json:"ip" bson:"ip"`
+	Firmware string    `json:"firmware" bson:"firmware"`
+	Uptime   int64     `json:"uptime" bson:"uptime"` // seconds since the device booted
+}
+
+// deviceView : device status as sent out for a single device, with its liveliness
+type deviceView struct {
+	*auth.DeviceStatus
+	Online      bool          `json:"online"`
+	LiveUnknown bool          `json:"live_unknown,omitempty"` // cache was down, online and the heartbeat could not be had
+	Heartbeat   *DevHeartbeat `json:"heartbeat,omitempty"`
+	Meta        *DeviceMeta   `json:"meta,omitempty"` // only to the owner or an admin
+}
+
+func hbKey(serial string) string {
+	return fmt.Sprintf("devhb:%s", serial)
+}
+
+// saveHeartbeat : caches the heartbeat and marks the serial for flushing
+func saveHeartbeat(cache *auth.TokenCache, hb *DevHeartbeat) error {
+	_, err := cache.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(hbKey(hb.Serial), map[string]interface{}{
+			"lastseen": hb.LastSeen.Unix(),
+			"ip":       hb.IP,
+			"firmware": hb.Firmware,
+			"uptime":   hb.Uptime,
+		})
+		pipe.SAdd(hbDirtySet, hb.Serial)
+		return nil
+	})
+	if err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to record heartbeat", "saveHeartbeat/TxPipelined")
+	}
+	return nil
+}
+
+// cachedHeartbeat : reads the heartbeat from the cache, nil if the device hasnt sent one since the last flush
+func cachedHeartbeat(cache *auth.TokenCache, serial string) (*DevHeartbeat, error) {
+	vals, err := cache.HGetAll(hbKey(serial)).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to read heartbeat", "cachedHeartbeat/HGetAll")
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	seen, _ := strconv.ParseInt(vals["lastseen"], 10, 64)
+	uptime, _ := strconv.ParseInt(vals["uptime"], 10, 64)
+	return &DevHeartbeat{Serial: serial, LastSeen: time.Unix(seen, 0).UTC(), IP: vals["ip"], Firmware: vals["firmware"], Uptime: uptime}, nil
+}
+
+// lastHeartbeat : latest heartbeat of the device, cache first and then the database
+func lastHeartbeat(cache *auth.TokenCache, coll *mgo.Collection, serial string) (*DevHeartbeat, error) {
+	hb, err := cachedHeartbeat(cache, serial)
+	if err != nil || hb != nil {
+		return hb, err
+	}
+	hb = &DevHeartbeat{}
+	if err := coll.Find(bson.M{"serial": serial}).One(hb); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to read heartbeat", "lastHeartbeat/coll.Find().One()")
+	}
+	return hb, nil
+}
+
+// FlushHeartbeats : moves the cached heartbeats to the database, sends back the count of devices flushed
+// the cache entry is left as is so that reads are still served off the cache
+func FlushHeartbeats(cache *auth.TokenCache, coll *mgo.Collection) (int, error) {
+	count := 0
+	for {
+		serial, err := cache.SPop(hbDirtySet).Result()
+		if err == redis.Nil {
+			return count, nil
+		}
+		if err != nil {
+			return count, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to flush heartbeats", "FlushHeartbeats/SPop")
+		}
+		hb, err := cachedHeartbeat(cache, serial)
+		if err != nil {
+			return count, err
+		}
+		if hb == nil {
+			continue
+		}
+		if _, err := coll.Upsert(bson.M{"serial": serial}, hb); err != nil {
+			cache.SAdd(hbDirtySet, serial) // so that the next flush can pick it up again
+			return count, ex.NewErr(&ex.ErrQuery{}, err, "Failed to flush heartbeats", "FlushHeartbeats/coll.Upsert()")
+		}
+		count++
+	}
+}
+
+// newDeviceToken : token that the device uses to identify itself, user on the token is the serial of the device
+// the uuid of the token is recorded against the registration, tokens issued before this one stop working
+func newDeviceToken(devreg *auth.DeviceRegColl, serial string) (string, error) {
+	jt := auth.NewToken(serial, 0, Tokens.deviceExp())
+	tok, err := jt.ToString(os.Getenv("DEVC_SECRET"))
+	if err != nil {
+		return "", err
+	}
+	if err := devreg.Update(bson.M{"serial": serial}, bson.M{"$set": bson.M{"tokuuid": jt.UUID}}); err != nil {
+		return "", err
+	}
+	return string(tok), nil
+}
+
+// DeviceTokenCurrent : tells if the device token is the latest one issued to the device
+// registrations from before the tokens were tracked have none on record, any valid token is current for them
+func DeviceTokenCurrent(devreg *auth.DeviceRegColl, tok *auth.JWTok) (bool, error) {
+	rec := struct {
+		TokUUID string `bson:"tokuuid"`
+	}{}
+	if err := devreg.Find(bson.M{"serial": tok.User}).Select(bson.M{"tokuuid": 1}).One(&rec); err != nil {
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+		return false, ex.NewErr(&ex.ErrQuery{}, err, "Failed to verify device token", "DeviceTokenCurrent/devreg.Find().One()")
+	}
+	return rec.TokUUID == "" || rec.TokUUID == tok.UUID, nil
+}
+
+// HandlDevHeartbeat : devices report they are alive along with the firmware and uptime
+// the response carries the lock status so that the device need not poll for it
+func HandlDevHeartbeat(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devreg")
+	devregColl := val.(*auth.DeviceRegColl)
+	cache, cacClose := getTknCacFromCtx(c)
+	if cache == nil {
+		return
+	}
+	defer cacClose()
+	serial := c.Param("serial")
+
+	status, err := devregColl.DeviceOfSerial(serial)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	if *status == (auth.DeviceStatus{}) {
+		DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("No device with serial: %s found registered", serial), "Device is not registered", "HandlDevHeartbeat/DeviceOfSerial"), c)
+		return
+	}
+	hb := &DevHeartbeat{}
+	if err := c.ShouldBindJSON(hb); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read heartbeat, kindly check and send again", "HandlDevHeartbeat/ShouldBindJSON"), c)
+		return
+	}
+	hb.Serial = serial
+	hb.LastSeen = time.Now().UTC()
+	hb.IP = c.ClientIP()
+	if DigestErr(saveHeartbeat(cache, hb), c) != 0 {
+		return
+	}
+	c.JSON(http.StatusOK, auth.DeviceAuthResponse{Ok: true, Lock: status.Lock})
+}
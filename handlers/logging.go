@@ -0,0 +1,129 @@
+package handlers
+
+// Logging that cannot leak credentials
+// a hook on logrus scrubs every entry before it is written - passwords, authorization headers, tokens and the pii fields
+// with email as pii the addresses are masked wherever they turn up in the entry, not just in the email field
+// handlers log on the request logger from the context so that the entries carry the request they belong to
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// secretFields : fields that are always masked, matched case insensitive on the field name
+	secretFields = []string{"password", "passwd", "secret", "token", "authorization", "auth", "refr", "cookie", "access_token"}
+	// secretPatterns : secrets that turn up inside messages and field values, the key is left in for the log to still make sense
+	secretPatterns = []struct {
+		rx   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},                     // jwt
+		{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9+/=._~-]+`), "${1} " + redacted},                  // authorization header values
+		{regexp.MustCompile(`(?i)\b(passw(?:or)?d)(\s*[=:]\s*|\s+)[^\s&,;"']+`), "${1}${2}" + redacted},         // passwd=, passwd: , Passwd <value>
+		{regexp.MustCompile(`(?i)\b(secret|access_token|token)(\s*[=:]\s*)[^\s&,;"']+`), "${1}${2}" + redacted}, // token=, secret:
+	}
+	// emailPattern : email addresses inside messages and field values, masked when email is one of the pii fields
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+)
+
+// RedactHook : logrus hook that masks secrets and pii before the entry is written
+type RedactHook struct {
+	mu  sync.RWMutex
+	pii map[string]bool // field names that are personal data, masked alongside the secrets
+}
+
+// NewRedactHook : hook masking the secrets, and the pii fields given
+func NewRedactHook(pii ...string) *RedactHook {
+	rh := &RedactHook{}
+	rh.SetPII(pii...)
+	return rh
+}
+
+// SetPII : replaces the pii fields, config is loaded after the hook is in place
+func (rh *RedactHook) SetPII(fields ...string) {
+	pii := map[string]bool{}
+	for _, f := range fields {
+		pii[strings.ToLower(f)] = true
+	}
+	rh.mu.Lock()
+	rh.pii = pii
+	rh.mu.Unlock()
+}
+
+// Levels : all the levels are scrubbed
+func (rh *RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// isSecretField : field name that carries a secret or pii
+func (rh *RedactHook) isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, f := range secretFields {
+		if name == f || strings.HasSuffix(name, "_"+f) || strings.HasSuffix(name, "."+f) {
+			return true
+		}
+	}
+	rh.mu.RLock()
+	defer rh.mu.RUnlock()
+	return rh.pii[name]
+}
+
+// scrub : masks the secrets inside the text, and the email addresses when email is pii
+func (rh *RedactHook) scrub(text string) string {
+	text = Scrub(text)
+	rh.mu.RLock()
+	defer rh.mu.RUnlock()
+	if rh.pii["email"] {
+		text = emailPattern.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+// Fire : masks the secret fields and scrubs the message and the remaining string fields
+func (rh *RedactHook) Fire(entry *log.Entry) error {
+	entry.Message = rh.scrub(entry.Message)
+	for k, v := range entry.Data {
+		if rh.isSecretField(k) {
+			entry.Data[k] = redacted
+			continue
+		}
+		switch val := v.(type) {
+		case string:
+			entry.Data[k] = rh.scrub(val)
+		case error:
+			entry.Data[k] = rh.scrub(val.Error())
+		}
+	}
+	return nil
+}
+
+// Scrub : masks the secrets inside the text
+func Scrub(text string) string {
+	for _, p := range secretPatterns {
+		text = p.rx.ReplaceAllString(text, p.repl)
+	}
+	return text
+}
+
+// UserHash : stands in for the account in the logs, email is personal data
+// same keyed hash that the audit trail has as actor_hash, so the two can be matched up
+func UserHash(email string) string {
+	return auditValHash(email)
+}
+
+// Logger : request logger from the context, the standard logger when there isnt one
+func Logger(c *gin.Context) *log.Entry {
+	if val, ok := c.Get("logger"); ok {
+		if entry, ok := val.(*log.Entry); ok {
+			return entry
+		}
+	}
+	return log.NewEntry(log.StandardLogger())
+}
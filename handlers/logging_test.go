@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLog : logger writing to a buffer through the redaction hook, text and json formats both
+func captureLog(json bool, pii ...string) (*log.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	l := log.New()
+	l.SetOutput(buf)
+	l.SetLevel(log.TraceLevel)
+	if json {
+		l.SetFormatter(&log.JSONFormatter{})
+	}
+	l.AddHook(NewRedactHook(pii...))
+	return l, buf
+}
+
+func TestRedactSecrets(t *testing.T) {
+	passwd := "Sup3r$ecretPa55"
+	tok, err := auth.NewToken("someone@gmail.com", 2, time.Minute).ToString("testsecret")
+	assert.Nil(t, err)
+	basic := b64.StdEncoding.EncodeToString([]byte("someone@gmail.com:" + passwd))
+	for _, json := range []bool{false, true} {
+		l, buf := captureLog(json)
+		// the very line that used to be in b64UserCredsParse
+		l.Infof("Email %s Passwd %s", "someone@gmail.com", passwd)
+		l.Infof("password=%s&next=1", passwd)
+		l.Warnf("Authorization: Bearer %s", tok)
+		l.Warnf("Authorization: Basic %s", basic)
+		l.Errorf("token %s failed to parse", tok)
+		l.Infof("/events?access_token=%s", tok)
+		l.WithFields(log.Fields{"passwd": passwd, "Authorization": "Bearer " + string(tok), "refr": string(tok), "device_token": string(tok)}).Info("fields")
+		l.WithField("err", fmt.Errorf("failed for secret: %s", passwd)).Error("error field")
+		out := buf.String()
+		assert.NotContains(t, out, passwd, "Password leaked into the log")
+		assert.NotContains(t, out, string(tok), "Token leaked into the log")
+		assert.NotContains(t, out, basic, "Basic credentials leaked into the log")
+		assert.Contains(t, out, redacted)
+	}
+}
+
+func TestRedactPII(t *testing.T) {
+	l, buf := captureLog(false, "email", "Phone")
+	l.WithFields(log.Fields{"email": "someone@gmail.com", "phone": "+919000000000", "serial": "000000007920365b"}).Info("account")
+	out := buf.String()
+	assert.NotContains(t, out, "someone@gmail.com")
+	assert.NotContains(t, out, "+919000000000")
+	assert.Contains(t, out, "000000007920365b", "Fields that arent pii should be left as they are")
+
+	// email addresses in the messages and the other fields
+	buf.Reset()
+	l.WithField("user", "other.one@mail.example.in").Warnf("token of %s used by %s", "someone@gmail.com", "other.one@mail.example.in")
+	l.WithError(fmt.Errorf("no account for someone@gmail.com")).Error("login")
+	out = buf.String()
+	assert.NotContains(t, out, "someone@gmail.com")
+	assert.NotContains(t, out, "other.one@mail.example.in")
+	assert.Contains(t, out, "token of "+redacted+" used by "+redacted)
+
+	// pii can be changed after the hook is in place
+	hook := NewRedactHook()
+	l, buf = captureLog(false)
+	l.ReplaceHooks(log.LevelHooks{})
+	l.AddHook(hook)
+	l.WithField("email", "someone@gmail.com").Info("before")
+	assert.Contains(t, buf.String(), "someone@gmail.com")
+	hook.SetPII("email")
+	buf.Reset()
+	l.WithField("email", "someone@gmail.com").Info("after")
+	assert.NotContains(t, buf.String(), "someone@gmail.com")
+}
+
+func TestRedactLeavesMessages(t *testing.T) {
+	// ordinary messages should read the same after scrubbing
+	for _, msg := range []string{
+		"Device token does not belong to the device",
+		"Failed to issue device token",
+		"Authentication expired, please sign again",
+		"Invalid credentials in the request authorization",
+	} {
+		assert.Equal(t, msg, Scrub(msg))
+	}
+}
+
+// TestRedactErrx : errors digested in the handlers are logged on the standard logger
+func TestRedactErrx(t *testing.T) {
+	passwd := "Sup3r$ecretPa55"
+	buf := &bytes.Buffer{}
+	std := log.StandardLogger()
+	out, hooks := std.Out, std.Hooks
+	defer func() {
+		std.SetOutput(out)
+		std.ReplaceHooks(hooks)
+	}()
+	std.SetOutput(buf)
+	std.ReplaceHooks(log.LevelHooks{})
+	std.AddHook(NewRedactHook())
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ex.DigestErr(ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("login failed for passwd %s", passwd), "Invalid credentials", "TestRedactErrx"), c)
+	Logger(c).Infof("Passwd: %s", passwd)
+	assert.NotContains(t, buf.String(), passwd)
+
+	// digested here the error is on the request logger
+	buf.Reset()
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("logger", log.WithField("request_id", "req-1"))
+	DigestErr(ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("login failed for passwd %s", passwd), "Invalid credentials", "TestRedactErrx"), c)
+	assert.Equal(t, http.StatusUnauthorized, c.Writer.Status())
+	assert.Contains(t, buf.String(), "request_id=req-1")
+	assert.NotContains(t, buf.String(), passwd)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+// Metrics on the default prometheus registry, served on /metrics
+// labels are kept to route templates and fixed outcomes so that the series do not grow with the users or devices
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_http_requests_total",
+		Help: "Requests handled, by route template, method and status",
+	}, []string{"route", "method", "status"})
+	httpLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authapi_http_request_duration_seconds",
+		Help:    "Time taken to handle the request, by route template and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_logins_total",
+		Help: "Login attempts by outcome - ok, failed",
+	}, []string{"outcome"})
+	refreshTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_token_refresh_total",
+		Help: "Token refreshes by outcome - ok, failed",
+	}, []string{"outcome"})
+	logoutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_logouts_total",
+		Help: "Token logouts by outcome - ok, failed",
+	}, []string{"outcome"})
+	storeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authapi_store_duration_seconds",
+		Help:    "Time taken by calls to the stores, by store (mongo, redis) and operation",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"store", "op"})
+	devicesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "authapi_devices",
+		Help: "Devices by state - registered, locked, blacklisted, sampled periodically",
+	}, []string{"state"})
+)
+
+// outcome : label value for the counters
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// ObserveRequest : counts the request and its latency, route is the template and not the path
+func ObserveRequest(route, method, status string, took time.Duration) {
+	if route == "" {
+		route = "unmatched" // 404s on random paths would otherwise be a series each
+	}
+	httpRequests.WithLabelValues(route, method, status).Inc()
+	httpLatency.WithLabelValues(route, method).Observe(took.Seconds())
+}
+
+// ObserveStore : latency of a call to mongo or redis
+func ObserveStore(store, op string, took time.Duration) {
+	storeLatency.WithLabelValues(store, op).Observe(took.Seconds())
+}
+
+// SampleDevices : sets the device gauges off the database
+func SampleDevices(devreg, blacklist *mgo.Collection) error {
+	start := time.Now()
+	defer func() { ObserveStore("mongo", "sample_devices", time.Since(start)) }()
+	total, err := devreg.Count()
+	if err != nil {
+		return err
+	}
+	locked, err := devreg.Find(bson.M{"lock": true}).Count()
+	if err != nil {
+		return err
+	}
+	black, err := blacklist.Count()
+	if err != nil {
+		return err
+	}
+	devicesGauge.WithLabelValues("registered").Set(float64(total))
+	devicesGauge.WithLabelValues("locked").Set(float64(locked))
+	devicesGauge.WithLabelValues("blacklisted").Set(float64(black))
+	return nil
+}
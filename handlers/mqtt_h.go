@@ -0,0 +1,241 @@
+package handlers
+
+// Auth plugin endpoints for the mqtt broker (mosquitto-go-auth http backend)
+// broker asks if the client can connect, if it is a superuser and if it can read/write a topic - 200 allows, anything else denies
+// devices connect with the serial as username and the device token as password, users with the email and the auth token
+// all device topics are under devices/<serial>/ so access follows ownership of the device
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MQTTServiceUser : username the api connects to the broker with, password is MQTT_SECRET
+// this is the only superuser on the broker
+var MQTTServiceUser = "authapi"
+
+// acc values as sent by the broker on acl checks
+const (
+	mqttRead      = 1
+	mqttWrite     = 2
+	mqttReadWrite = 3
+	mqttSubscribe = 4
+)
+
+// mqttReq : the broker sends these either as form or json depending on its http_params_mode
+type mqttReq struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	ClientID string `json:"clientid" form:"clientid"`
+	Topic    string `json:"topic" form:"topic"`
+	Acc      int    `json:"acc" form:"acc"`
+}
+
+// mqttDeny : broker only looks at the status, reason is for the logs
+func mqttDeny(c *gin.Context, reason string) {
+	DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("mqtt denied: %s", reason), "Denied", "mqtt"), c)
+}
+
+// isServiceUser : api itself connecting to push the commands
+func isServiceUser(username string) bool {
+	return MQTTServiceUser != "" && username == MQTTServiceUser
+}
+
+// isUserName : users connect with their email, devices with their serial
+func isUserName(username string) bool {
+	return strings.Contains(username, "@")
+}
+
+// topicSerial : serial the topic is about, empty if the topic is not a device topic or the serial is a wildcard
+func topicSerial(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 || parts[0] != "devices" || parts[1] == "+" || parts[1] == "#" || parts[1] == "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// deviceCanConnect : device has to be registered, not locked nor blacklisted
+func deviceCanConnect(devreg *auth.DeviceRegColl, blckl *auth.BlacklistColl, serial string) (bool, string, error) {
+	status, err := devreg.DeviceOfSerial(serial)
+	if err != nil {
+		return false, "", err
+	}
+	if *status == (auth.DeviceStatus{}) {
+		return false, "device not registered", nil
+	}
+	if status.Lock {
+		return false, "device locked", nil
+	}
+	black, err := blckl.Find(bson.M{"serial": serial}).Count()
+	if err != nil {
+		return false, "", ex.NewErr(&ex.ErrQuery{}, err, "Failed to check blacklist", "deviceCanConnect/blckl.Find().Count()")
+	}
+	if black > 0 {
+		return false, "device blacklisted", nil
+	}
+	return true, "", nil
+}
+
+// HandlMQTTUser : can the client connect to the broker
+func HandlMQTTUser(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	req := &mqttReq{}
+	if err := c.ShouldBind(req); err != nil || req.Username == "" || req.Password == "" {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read mqtt credentials", "HandlMQTTUser"), c)
+		return
+	}
+	switch {
+	case isServiceUser(req.Username):
+		secret := os.Getenv("MQTT_SECRET")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(req.Password)) != 1 {
+			mqttDeny(c, "service credentials do not match")
+			return
+		}
+	case isUserName(req.Username):
+		tok, err := auth.TokenStr(req.Password).Parse(os.Getenv("AUTH_SECRET"))
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if tok.User != req.Username {
+			mqttDeny(c, fmt.Sprintf("token of %s used by %s", tok.User, req.Username))
+			return
+		}
+		current, err := TokenCurrent(tok)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if !current {
+			mqttDeny(c, fmt.Sprintf("token of %s issued before the account changed", req.Username))
+			return
+		}
+		live, err := TokenLive(tok)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if !live {
+			mqttDeny(c, fmt.Sprintf("session of the token of %s has ended", req.Username))
+			return
+		}
+	default:
+		val, _ := c.Get("devreg")
+		devreg := val.(*auth.DeviceRegColl)
+		tok, err := auth.TokenStr(req.Password).Parse(os.Getenv("DEVC_SECRET"))
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if tok.User != req.Username {
+			mqttDeny(c, fmt.Sprintf("token of %s used by %s", tok.User, req.Username))
+			return
+		}
+		current, err := DeviceTokenCurrent(devreg, tok)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if !current {
+			mqttDeny(c, fmt.Sprintf("rotated token used by %s", req.Username))
+			return
+		}
+		val, _ = c.Get("devblacklist")
+		ok, reason, err := deviceCanConnect(devreg, val.(*auth.BlacklistColl), req.Username)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if !ok {
+			mqttDeny(c, fmt.Sprintf("%s: %s", req.Username, reason))
+			return
+		}
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HandlMQTTSuperuser : superusers skip the acl checks, only the api itself is one
+func HandlMQTTSuperuser(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	req := &mqttReq{}
+	if err := c.ShouldBind(req); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read mqtt request", "HandlMQTTSuperuser"), c)
+		return
+	}
+	if !isServiceUser(req.Username) {
+		mqttDeny(c, fmt.Sprintf("%s is not a superuser", req.Username))
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HandlMQTTAcl : can the client read/write the topic
+// devices have full access under their own devices/<serial>/, owners can read and subscribe to their devices, admins to all devices
+// locked and blacklisted devices are denied here too, since they might have connected before they were locked
+// a locked device is thus off the broker altogether and gets its unlock command on the long-poll
+func HandlMQTTAcl(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("devreg")
+	devreg := val.(*auth.DeviceRegColl)
+	req := &mqttReq{}
+	if err := c.ShouldBind(req); err != nil || req.Username == "" || req.Topic == "" {
+		DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read mqtt acl request", "HandlMQTTAcl"), c)
+		return
+	}
+	readOnly := req.Acc == mqttRead || req.Acc == mqttSubscribe
+	if !readOnly && req.Acc != mqttWrite && req.Acc != mqttReadWrite {
+		mqttDeny(c, fmt.Sprintf("unknown acc %d", req.Acc))
+		return
+	}
+	serial := topicSerial(req.Topic)
+	if isUserName(req.Username) {
+		if !readOnly {
+			mqttDeny(c, fmt.Sprintf("%s cannot publish on %s", req.Username, req.Topic))
+			return
+		}
+		val, _ := c.Get("userreg")
+		details, err := val.(*auth.UserAccounts).AccountDetails(req.Username)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if details.Role >= 2 && strings.HasPrefix(req.Topic, "devices/") {
+			c.AbortWithStatus(http.StatusOK)
+			return
+		}
+		if serial == "" {
+			mqttDeny(c, fmt.Sprintf("%s cannot subscribe across devices on %s", req.Username, req.Topic))
+			return
+		}
+		status, err := devreg.DeviceOfSerial(serial)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if status.User != req.Username {
+			mqttDeny(c, fmt.Sprintf("%s does not own %s", req.Username, serial))
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	// devices
+	if serial != req.Username {
+		mqttDeny(c, fmt.Sprintf("%s cannot access %s", req.Username, req.Topic))
+		return
+	}
+	val, _ = c.Get("devblacklist")
+	ok, reason, err := deviceCanConnect(devreg, val.(*auth.BlacklistColl), serial)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	if !ok {
+		mqttDeny(c, fmt.Sprintf("%s: %s", serial, reason))
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
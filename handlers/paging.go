@@ -0,0 +1,186 @@
+package handlers
+
+// Cursor based pagination for the routes that enlist collections
+// sorting is always tied with _id so that the cursor can resume from a unique position
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// pageCursor : position of the last item sent out on the previous page
+type pageCursor struct {
+	Val interface{}   `json:"v,omitempty"`
+	ID  bson.ObjectId `json:"id"`
+}
+
+// pageReq : pagination and sorting as read from the request query
+// ?limit=20&sort=-name&cursor=<opaque>
+type pageReq struct {
+	Limit  int
+	Field  string // field in the collection, _id when sorting on creation
+	Desc   bool
+	Cursor *pageCursor
+}
+
+// readPageReq : reads the pagination query params, sortable is the map of query sort key to collection field
+func readPageReq(c *gin.Context, sortable map[string]string, dflt string) (*pageReq, error) {
+	pr := &pageReq{Limit: defaultPageSize}
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("invalid limit %s", l), "Page limit has to be a positive number", "readPageReq/limit")
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		pr.Limit = n
+	}
+	sort := c.DefaultQuery("sort", dflt)
+	if strings.HasPrefix(sort, "-") {
+		pr.Desc = true
+		sort = strings.TrimPrefix(sort, "-")
+	}
+	field, ok := sortable[sort]
+	if !ok {
+		return nil, ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("unsupported sort field %s", sort), fmt.Sprintf("Cannot sort on %s", sort), "readPageReq/sort")
+	}
+	pr.Field = field
+	if cur := c.Query("cursor"); cur != "" {
+		raw, err := b64.RawURLEncoding.DecodeString(cur)
+		if err != nil {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Invalid page cursor", "readPageReq/cursor")
+		}
+		pr.Cursor = &pageCursor{}
+		if err := json.Unmarshal(raw, pr.Cursor); err != nil || !pr.Cursor.ID.Valid() {
+			return nil, ex.NewErr(&ex.ErrInvalid{}, err, "Invalid page cursor", "readPageReq/cursor")
+		}
+	}
+	return pr, nil
+}
+
+// sortKeys : mgo sort arguments, _id breaks the ties
+func (pr *pageReq) sortKeys() []string {
+	dir := ""
+	if pr.Desc {
+		dir = "-"
+	}
+	if pr.Field == "_id" {
+		return []string{dir + "_id"}
+	}
+	return []string{dir + pr.Field, dir + "_id"}
+}
+
+// resumeQ : filter that picks up items after the cursor
+func (pr *pageReq) resumeQ() bson.M {
+	op := "$gt"
+	if pr.Desc {
+		op = "$lt"
+	}
+	if pr.Field == "_id" {
+		return bson.M{"_id": bson.M{op: pr.Cursor.ID}}
+	}
+	return bson.M{"$or": []bson.M{
+		{pr.Field: bson.M{op: pr.Cursor.Val}},
+		{pr.Field: pr.Cursor.Val, "_id": bson.M{op: pr.Cursor.ID}},
+	}}
+}
+
+// findPage : gets one page of documents for the filter along with the total count of the filter
+// next is empty when there are no more pages
+func findPage(coll *mgo.Collection, filter bson.M, pr *pageReq) (docs []bson.M, next string, total int, err error) {
+	total, err = coll.Find(filter).Count()
+	if err != nil {
+		return nil, "", 0, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get the list, gateway failed", "findPage/coll.Find().Count()")
+	}
+	q := filter
+	if pr.Cursor != nil {
+		q = bson.M{"$and": []bson.M{filter, pr.resumeQ()}}
+	}
+	docs = []bson.M{}
+	// one extra document tells us if there is a next page
+	if err = coll.Find(q).Sort(pr.sortKeys()...).Limit(pr.Limit + 1).All(&docs); err != nil {
+		return nil, "", 0, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get the list, gateway failed", "findPage/coll.Find().All()")
+	}
+	if len(docs) > pr.Limit {
+		docs = docs[:pr.Limit]
+		last := docs[len(docs)-1]
+		id, ok := last["_id"].(bson.ObjectId)
+		if !ok {
+			// cursor resumes from the object id, documents keyed otherwise cannot be paged
+			return nil, "", 0, newErrInternal(fmt.Errorf("document _id %v is not an object id", last["_id"]), "Failed to get the list", "findPage/cursor")
+		}
+		cur := pageCursor{ID: id}
+		if pr.Field != "_id" {
+			cur.Val = last[pr.Field]
+		}
+		raw, _ := json.Marshal(cur)
+		next = b64.RawURLEncoding.EncodeToString(raw)
+	}
+	return docs, next, total, nil
+}
+
+// bsonTo : converts the generic document to the typed object
+func bsonTo(doc bson.M, out interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, out)
+}
+
+// setPageHeaders : total count and the Link header for navigating the pages
+func setPageHeaders(c *gin.Context, next string, total int) {
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	link := func(cursor, rel string) string {
+		u := *c.Request.URL
+		q := u.Query()
+		q.Del("cursor")
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		u.RawQuery = q.Encode()
+		return fmt.Sprintf("<%s>; rel=\"%s\"", u.RequestURI(), rel)
+	}
+	links := []string{link("", "first")}
+	if next != "" {
+		links = append(links, link(next, "next"))
+	}
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+// regexQ : case insensitive regex query, the text from the client is always quoted
+func regexQ(text string, whole bool) bson.RegEx {
+	pattern := regexp.QuoteMeta(text)
+	if whole {
+		pattern = "^" + pattern + "$"
+	}
+	return bson.RegEx{Pattern: pattern, Options: "i"}
+}
+
+// intQuery : reads the query param as an integer, ok is false when the param isnt sent
+func intQuery(c *gin.Context, key string) (val int, ok bool, err error) {
+	s := c.Query(key)
+	if s == "" {
+		return 0, false, nil
+	}
+	val, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, false, ex.NewErr(&ex.ErrInvalid{}, err, fmt.Sprintf("Query param %s has to be a number", key), "intQuery")
+	}
+	return val, true, nil
+}
@@ -0,0 +1,279 @@
+package handlers
+
+// Lock schedules keep devices unlocked within weekly windows and locked outside of them
+// the scheduler compares the state the schedule wants against the state it last applied
+// since the applied state is persisted, a restart still catches up on transitions it missed
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// LockWindow : hours on the given days when the device stays unlocked
+// Start and End are 24 hour clock 09:00 - 18:30, End before Start runs over midnight
+type LockWindow struct {
+	Days  []string `json:"days" bson:"days"` // mon tue wed ..
+	Start string   `json:"start" bson:"start"`
+	End   string   `json:"end" bson:"end"`
+}
+
+// clockMins : minutes since midnight for the 24 hour clock
+func clockMins(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// covers : tells if the time (already in the schedule's zone) is within the window
+func (w *LockWindow) covers(t time.Time) bool {
+	start, _ := clockMins(w.Start)
+	end, _ := clockMins(w.End)
+	now := t.Hour()*60 + t.Minute()
+	onDay := func(d time.Weekday) bool {
+		for _, day := range w.Days {
+			if weekdays[strings.ToLower(day)] == d {
+				return true
+			}
+		}
+		return false
+	}
+	if start < end {
+		return onDay(t.Weekday()) && now >= start && now < end
+	}
+	// window runs over midnight, the later part belongs to the day the window started on
+	return (onDay(t.Weekday()) && now >= start) || (onDay((t.Weekday()+6)%7) && now < end)
+}
+
+// LockSchedule : weekly unlocked windows for a device or a group of devices
+type LockSchedule struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	Serial   string        `json:"serial,omitempty" bson:"serial,omitempty"`
+	Group    string        `json:"group,omitempty" bson:"group,omitempty"`
+	TimeZone string        `json:"tz" bson:"tz"` // Asia/Kolkata
+	Windows  []LockWindow  `json:"windows" bson:"windows"`
+	// state last applied by the scheduler, empty till the scheduler gets to it
+	Applied   string     `json:"applied,omitempty" bson:"applied,omitempty"` // lock / unlock
+	AppliedAt *time.Time `json:"applied_at,omitempty" bson:"applied_at,omitempty"`
+	// devices that have the applied state, devices joining the group later get it on the next run
+	AppliedTo []string `json:"applied_to,omitempty" bson:"applied_to,omitempty"`
+}
+
+// validate : schedule is either for a device or a group, has a known time zone and valid windows
+func (ls *LockSchedule) validate() error {
+	if (ls.Serial == "") == (ls.Group == "") {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Schedule is either for a device serial or a group", "LockSchedule.validate")
+	}
+	if _, err := time.LoadLocation(ls.TimeZone); err != nil || ls.TimeZone == "" {
+		return ex.NewErr(&ex.ErrInvalid{}, err, fmt.Sprintf("Unknown time zone %s", ls.TimeZone), "LockSchedule.validate/tz")
+	}
+	if len(ls.Windows) == 0 {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Schedule needs at least one window", "LockSchedule.validate/windows")
+	}
+	for _, w := range ls.Windows {
+		if len(w.Days) == 0 {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, "Window needs at least one day", "LockSchedule.validate/days")
+		}
+		for _, d := range w.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Invalid day %s, expected mon tue wed thu fri sat sun", d), "LockSchedule.validate/days")
+			}
+		}
+		start, err1 := clockMins(w.Start)
+		end, err2 := clockMins(w.End)
+		if err1 != nil || err2 != nil || start == end {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Invalid window %s-%s, expected 24 hour clock like 09:00-18:00", w.Start, w.End), "LockSchedule.validate/window")
+		}
+	}
+	return nil
+}
+
+// Want : state the schedule wants the devices in at the given time
+func (ls *LockSchedule) Want(at time.Time) string {
+	loc, err := time.LoadLocation(ls.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := at.In(loc)
+	for _, w := range ls.Windows {
+		if w.covers(local) {
+			return "unlock"
+		}
+	}
+	return "lock"
+}
+
+// ApplySchedules : brings the devices under each schedule to the state that the schedule wants
+// schedules already in the wanted state are left alone except for devices that joined the group since, sends back the count of schedules that had a transition
+// applied state is saved only when all the devices got it, devices that failed are tried again on the next run and reported in the error
+func ApplySchedules(schedules *mgo.Collection, devreg *auth.DeviceRegColl, groups *mgo.Collection, now time.Time) (applied int, err error) {
+	all := []LockSchedule{}
+	if err := schedules.Find(bson.M{}).All(&all); err != nil {
+		return 0, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get lock schedules", "ApplySchedules/schedules.Find().All()")
+	}
+	failed := []string{}
+	for _, ls := range all {
+		want := ls.Want(now)
+		if ls.Applied == want && ls.Group == "" {
+			continue
+		}
+		serials := []string{ls.Serial}
+		if ls.Group != "" {
+			// group that cant be resolved now leaves the schedule as is, the next run tries again
+			g, err := findGroup(groups, ls.Group)
+			if err != nil {
+				continue
+			}
+			if serials, err = ResolveGroup(devreg, g); err != nil {
+				continue
+			}
+		}
+		done := map[string]bool{}
+		if ls.Applied == want {
+			for _, s := range ls.AppliedTo {
+				done[s] = true
+			}
+		}
+		reached, ok, changed := []string{}, true, false
+		for _, s := range serials {
+			if done[s] {
+				reached = append(reached, s)
+				continue
+			}
+			changed = true
+			if err := applyDevAction(devreg, nil, want, s, ""); err != nil {
+				// devices that are not registered anymore are of no concern to the schedule
+				if x, isx := err.(ex.Errx); !isx || x.HTTPStatusCode() != http.StatusNotFound {
+					failed, ok = append(failed, fmt.Sprintf("%s %s: %s", ls.ID.Hex(), s, err)), false
+					continue
+				}
+			}
+			reached = append(reached, s)
+		}
+		if ls.Applied == want && !changed && len(reached) == len(ls.AppliedTo) {
+			continue // group is as it was
+		}
+		set := bson.M{"applied_to": reached}
+		if ls.Applied != want {
+			if !ok {
+				continue // devices that got the state get it again on the next run
+			}
+			set["applied"], set["applied_at"] = want, now.UTC()
+		}
+		if err := schedules.UpdateId(ls.ID, bson.M{"$set": set}); err != nil {
+			return applied, ex.NewErr(&ex.ErrQuery{}, err, "Failed to save schedule state", "ApplySchedules/schedules.UpdateId()")
+		}
+		if ls.Applied != want {
+			applied++
+		}
+	}
+	if len(failed) > 0 {
+		return applied, ex.NewErr(&ex.ErrQuery{}, fmt.Errorf("%s", strings.Join(failed, ", ")), "Failed to apply lock schedules on some devices", "ApplySchedules/applyDevAction")
+	}
+	return applied, nil
+}
+
+// HandlSchedules : enlisting and creating lock schedules
+func HandlSchedules(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("lockschedules")
+	schedules := val.(*mgo.Collection)
+	if c.Request.Method == "GET" {
+		// /schedules?serial= /schedules?group= for the schedules of the device or group
+		filter := bson.M{}
+		if s := c.Query("serial"); s != "" {
+			filter["serial"] = s
+		}
+		if g := c.Query("group"); g != "" {
+			filter["group"] = g
+		}
+		result := []LockSchedule{}
+		if err := schedules.Find(filter).All(&result); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get lock schedules", "HandlSchedules/GET"), c)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	} else if c.Request.Method == "POST" {
+		ls := &LockSchedule{}
+		if err := c.ShouldBindJSON(ls); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read lock schedule, kindly check and send again", "HandlSchedules/POST"), c)
+			return
+		}
+		if DigestErr(ls.validate(), c) != 0 {
+			return
+		}
+		if ls.Serial != "" {
+			val, _ := c.Get("devreg")
+			isReg, err := val.(*auth.DeviceRegColl).IsDeviceRegistered(ls.Serial)
+			if DigestErr(err, c) != 0 {
+				return
+			}
+			if !isReg {
+				DigestErr(ex.NewErr(&ex.ErrNotFound{}, nil, "Cannot schedule an unregistered device", "HandlSchedules/POST"), c)
+				return
+			}
+		} else {
+			val, _ := c.Get("devgroups")
+			if _, err := findGroup(val.(*mgo.Collection), ls.Group); DigestErr(err, c) != 0 {
+				return
+			}
+		}
+		ls.ID = bson.NewObjectId()
+		ls.Applied, ls.AppliedAt, ls.AppliedTo = "", nil, nil // scheduler applies the state on its next run
+		if err := schedules.Insert(ls); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to create lock schedule", "HandlSchedules/schedules.Insert()"), c)
+			return
+		}
+		c.JSON(http.StatusOK, ls)
+		return
+	}
+}
+
+// HandlSchedule : getting or removing a single lock schedule
+func HandlSchedule(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("lockschedules")
+	schedules := val.(*mgo.Collection)
+	id := c.Param("id")
+	if !bson.IsObjectIdHex(id) {
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid schedule id", "HandlSchedule"), c)
+		return
+	}
+	ls := &LockSchedule{}
+	if err := schedules.FindId(bson.ObjectIdHex(id)).One(ls); err != nil {
+		if err == mgo.ErrNotFound {
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, err, "No such lock schedule", "HandlSchedule"), c)
+			return
+		}
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get lock schedule", "HandlSchedule/schedules.FindId()"), c)
+		return
+	}
+	if c.Request.Method == "GET" {
+		c.JSON(http.StatusOK, gin.H{"schedule": ls, "want": ls.Want(time.Now())})
+		return
+	} else if c.Request.Method == "DELETE" {
+		if err := schedules.RemoveId(ls.ID); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to remove lock schedule", "HandlSchedule/schedules.RemoveId()"), c)
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLockWindowCovers : windows within the day and windows that run over midnight
+func TestLockWindowCovers(t *testing.T) {
+	// 1 Mar 2021 is a monday
+	at := func(day, hh, mm int) time.Time { return time.Date(2021, 3, day, hh, mm, 0, 0, time.UTC) }
+	day := LockWindow{Days: []string{"mon", "wed"}, Start: "09:00", End: "18:30"}
+	night := LockWindow{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}
+	sunday := LockWindow{Days: []string{"sun"}, Start: "23:00", End: "01:00"}
+	tests := []struct {
+		w    LockWindow
+		t    time.Time
+		want bool
+		desc string
+	}{
+		{day, at(1, 9, 0), true, "start of the window"},
+		{day, at(1, 18, 29), true, "just before the end"},
+		{day, at(1, 18, 30), false, "end is not in the window"},
+		{day, at(1, 8, 59), false, "before the window"},
+		{day, at(2, 12, 0), false, "not on the day"},
+		{day, at(3, 12, 0), true, "on the other day"},
+		{night, at(5, 22, 0), true, "friday night"},
+		{night, at(5, 23, 59), true, "friday before midnight"},
+		{night, at(6, 0, 0), true, "saturday after midnight"},
+		{night, at(6, 5, 59), true, "saturday before the end"},
+		{night, at(6, 6, 0), false, "saturday at the end"},
+		{night, at(5, 5, 0), false, "friday morning belongs to thursday's window"},
+		{night, at(6, 22, 30), false, "saturday night is not in the window"},
+		{sunday, at(7, 23, 30), true, "sunday night"},
+		{sunday, at(8, 0, 30), true, "runs over into monday"},
+		{sunday, at(2, 0, 30), false, "tuesday after midnight"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.w.covers(tt.t), tt.desc)
+	}
+}
+
+// TestScheduleWant : state is worked out in the schedule's time zone
+func TestScheduleWant(t *testing.T) {
+	ls := &LockSchedule{TimeZone: "Asia/Kolkata", Windows: []LockWindow{
+		{Days: []string{"mon"}, Start: "09:00", End: "18:00"},
+		{Days: []string{"sat"}, Start: "20:00", End: "02:00"},
+	}}
+	tests := []struct {
+		at   time.Time
+		want string
+		desc string
+	}{
+		{time.Date(2021, 3, 1, 3, 30, 0, 0, time.UTC), "unlock", "09:00 monday in Kolkata"},
+		{time.Date(2021, 3, 1, 3, 29, 0, 0, time.UTC), "lock", "08:59 monday in Kolkata"},
+		{time.Date(2021, 3, 1, 12, 30, 0, 0, time.UTC), "lock", "18:00 monday in Kolkata"},
+		{time.Date(2021, 3, 6, 20, 0, 0, 0, time.UTC), "unlock", "01:30 sunday in Kolkata, saturday's window"},
+		{time.Date(2021, 3, 6, 20, 30, 0, 0, time.UTC), "lock", "02:00 sunday in Kolkata"},
+		{time.Date(2021, 3, 6, 14, 0, 0, 0, time.UTC), "lock", "19:30 saturday in Kolkata"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ls.Want(tt.at), tt.desc)
+	}
+	// unknown zone falls back to UTC
+	ls.TimeZone = "Nowhere/Place"
+	assert.Equal(t, "unlock", ls.Want(time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)))
+}
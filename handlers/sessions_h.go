@@ -0,0 +1,389 @@
+package handlers
+
+// Sessions - each login is a session that lives on as long as its refresh token is refreshed
+// the tokens in the cache are keyed on their uuids, the session records which of them are its own
+// revoking a session takes its tokens out of the cache: the refresh token cannot be used again
+// and the access token is refused on every route right away, tokenParse checks the session it is on is still live
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+)
+
+// Session : one login of the user, from one client
+type Session struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Role      int       `json:"role"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Client    string    `json:"client"` // web, mobile, device - the token lifetimes are by the client
+	Created   time.Time `json:"created"`
+	Refreshed time.Time `json:"refreshed"`
+	Expires   time.Time `json:"expires"` // when the refresh token expires, unless refreshed
+	Current   bool      `json:"current"` // session of the token the request came with
+	authUUID  string
+	refrUUID  string
+}
+
+func sessKey(id string) string {
+	return fmt.Sprintf("session:%s", id)
+}
+
+// userSessKey : set of the session ids of the user, ids of the sessions that have lapsed are pruned on listing
+func userSessKey(email string) string {
+	return fmt.Sprintf("sessions:%s", email)
+}
+
+// tokSessKey : session the token belongs to, keyed on the token uuid
+func tokSessKey(tokUUID string) string {
+	return fmt.Sprintf("sessof:%s", tokUUID)
+}
+
+// tokenSession : id of the session the token belongs to, empty when the session has ended
+func tokenSession(cache *auth.TokenCache, tok *auth.JWTok) (string, error) {
+	id, err := cache.Get(tokSessKey(tok.UUID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get session", "tokenSession")
+	}
+	return id, nil
+}
+
+// TokenLive : the session the access token was issued on has not ended, ending it takes the lookup off the cache
+// refresh tokens are not checked here, ClaimRefresh tells a token used again from one that was never issued
+func TokenLive(tok *auth.JWTok) (bool, error) {
+	if TokenGens == nil {
+		return true, nil
+	}
+	n, err := TokenGens.cache.Exists(tokSessKey(tok.UUID)).Result()
+	if err != nil {
+		return false, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to verify authorization", "TokenLive")
+	}
+	return n > 0, nil
+}
+
+// saveSession : session, the tokens just issued on it and the lookups from the tokens
+// the tokens are keyed the way auth.TokenCache.LoginUser would, the session lives as long as its refresh token
+func saveSession(pipe redis.Pipeliner, s *Session, pair *auth.TokenPair) {
+	pipe.Set(pair.Auth.UUID, pair.Refr.UUID, pair.Auth.Exp)
+	pipe.Set(pair.Refr.UUID, pair.Refr.User, pair.Refr.Exp)
+	pipe.HSet(sessKey(s.ID), map[string]interface{}{
+		"user":      s.User,
+		"role":      s.Role,
+		"ua":        s.UserAgent,
+		"ip":        s.IP,
+		"client":    s.Client,
+		"created":   s.Created.Unix(),
+		"refreshed": s.Refreshed.Unix(),
+		"expires":   s.Expires.Unix(),
+		"auth":      s.authUUID,
+		"refr":      s.refrUUID,
+	})
+	pipe.Expire(sessKey(s.ID), pair.Refr.Exp)
+	pipe.SAdd(userSessKey(s.User), s.ID)
+	pipe.Set(tokSessKey(s.authUUID), s.ID, pair.Auth.Exp)
+	pipe.Set(tokSessKey(s.refrUUID), s.ID, pair.Refr.Exp)
+}
+
+// startSession : records the login and issues the tokens on it
+// gen is the generation of the account, read before the account was
+func startSession(cache *auth.TokenCache, email string, role int, client string, gen int64, c *gin.Context) (*auth.TokenPair, error) {
+	now := time.Now()
+	s := &Session{
+		ID:        uuid.New().String(),
+		User:      email,
+		Role:      role,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		Client:    client,
+		Created:   now,
+		Refreshed: now,
+	}
+	pair, err := issueTokens(s, gen)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cache.TxPipelined(func(pipe redis.Pipeliner) error {
+		saveSession(pipe, s, pair)
+		return nil
+	}); err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to start session", "startSession")
+	}
+	return pair, nil
+}
+
+// getSession : session by id, nil if it has ended
+func getSession(cache *auth.TokenCache, id string) (*Session, error) {
+	vals, err := cache.HGetAll(sessKey(id)).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get session", "getSession")
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	role, _ := strconv.Atoi(vals["role"])
+	created, _ := strconv.ParseInt(vals["created"], 10, 64)
+	refreshed, _ := strconv.ParseInt(vals["refreshed"], 10, 64)
+	s := &Session{
+		ID:        id,
+		User:      vals["user"],
+		Role:      role,
+		UserAgent: vals["ua"],
+		IP:        vals["ip"],
+		Client:    vals["client"],
+		Created:   time.Unix(created, 0),
+		Refreshed: time.Unix(refreshed, 0),
+		authUUID:  vals["auth"],
+		refrUUID:  vals["refr"],
+	}
+	if expires, _ := strconv.ParseInt(vals["expires"], 10, 64); expires > 0 {
+		s.Expires = time.Unix(expires, 0) // sessions from before there were expiries on them have none
+	}
+	return s, nil
+}
+
+// usedRefrKey : refresh token that has been used, kept for as long as the token could still verify
+// the value is the session it was on, presenting the token again ends that session
+func usedRefrKey(tokUUID string) string {
+	return fmt.Sprintf("refrused:%s", tokUUID)
+}
+
+// ClaimRefresh : refresh token is claimed on the way in, before anything else is done with it
+// each refresh token can be used once, the session is the family of the tokens refreshed one from the other
+// a refresh token used a second time is taken as stolen - the session is revoked, the reuse recorded and the request turned away
+// the session of the token claimed is put on the context for HndlAuthrz to refresh
+func ClaimRefresh(c *gin.Context, refr *auth.JWTok) error {
+	val, _ := c.Get("cache")
+	cache, _ := val.(*auth.TokenCache)
+	if cache == nil {
+		return ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("no cache connection found middleware"), "One or more gateways on the server has failed", "ClaimRefresh")
+	}
+	id, reused, err := claimRefresh(cache, refr)
+	if reused != nil {
+		tokenReused(c, refr, reused)
+	}
+	if err != nil {
+		refreshTotal.WithLabelValues(outcome(err)).Inc()
+		// the handler that would have closed it is not reached
+		if val, ok := c.Get("cache_close"); ok {
+			val.(func())()
+		}
+		return err
+	}
+	c.Set("refr_session", id)
+	return nil
+}
+
+// claimRefresh : session id of the refresh token, the token is marked used in the same step
+// a token used already revokes the session it was on, which is sent back so that the caller can record it
+func claimRefresh(cache *auth.TokenCache, refr *auth.JWTok) (string, *Session, error) {
+	id, err := tokenSession(cache, refr)
+	if err != nil {
+		return "", nil, err
+	}
+	if id == "" {
+		family, err := cache.Get(usedRefrKey(refr.UUID)).Result()
+		if err == redis.Nil {
+			return "", nil, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("refresh token %s is not on a live session", refr.UUID), "Session has ended, please sign in again", "claimRefresh")
+		}
+		if err != nil {
+			return "", nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to refresh session", "claimRefresh")
+		}
+		s, err := revokeFamily(cache, family, refr)
+		return "", s, err
+	}
+	// of two refreshes racing on the same token only one gets through
+	// the lookup is renamed to the used mark in one step, the mark keeps its expiry
+	if err := cache.Rename(tokSessKey(refr.UUID), usedRefrKey(refr.UUID)).Err(); err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			s, err := revokeFamily(cache, id, refr)
+			return "", s, err
+		}
+		return "", nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to refresh session", "claimRefresh")
+	}
+	return id, nil, nil
+}
+
+// refreshSession : new pair of tokens on the session of the refresh token, ClaimRefresh has claimed the token already
+// the new tokens are of the same generation as the refresh token, refrTokenParse has checked that is the current one
+func refreshSession(cache *auth.TokenCache, id string, refr *auth.JWTok, pair *auth.TokenPair) error {
+	s, err := getSession(cache, id)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.refrUUID != refr.UUID {
+		return ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("refresh token %s is not on a live session", refr.UUID), "Session has ended, please sign in again", "refreshSession")
+	}
+	oldAuth := s.authUUID
+	issued, err := issueTokens(s, tokenGen(refr))
+	if err != nil {
+		// session has run its course, the refresh token was claimed already so the rest of it goes too
+		if _, rerr := revokeSessions(cache, []*Session{s}); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	s.Refreshed = time.Now()
+	if _, err := cache.TxPipelined(func(pipe redis.Pipeliner) error {
+		// the access token from before is retired along with the refresh token
+		pipe.Del(refr.UUID, oldAuth, tokSessKey(oldAuth))
+		// kept till the token lapses, exp is in seconds and the token verifies through that second
+		if used := time.Until(tokenExpiry(refr)) + time.Second; used > 0 {
+			pipe.Expire(usedRefrKey(refr.UUID), used)
+		}
+		saveSession(pipe, s, issued)
+		return nil
+	}); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to refresh session", "refreshSession")
+	}
+	*pair = *issued
+	return nil
+}
+
+// revokeFamily : refresh token reused, the session it was on is ended along with the tokens that were refreshed from it
+func revokeFamily(cache *auth.TokenCache, id string, refr *auth.JWTok) (*Session, error) {
+	s, err := getSession(cache, id)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		if _, err := revokeSessions(cache, []*Session{s}); err != nil {
+			return nil, err
+		}
+	} else {
+		s = &Session{ID: id, User: refr.User, Role: refr.Role} // ended already, the reuse is still to be recorded
+	}
+	return s, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("refresh token %s of session %s used again", refr.UUID, id), "Session has ended, please sign in again", "revokeFamily")
+}
+
+// endSession : takes the session and its tokens out of the cache
+func endSession(pipe redis.Pipeliner, s *Session) {
+	pipe.Del(sessKey(s.ID), s.authUUID, s.refrUUID, tokSessKey(s.authUUID), tokSessKey(s.refrUUID))
+	pipe.SRem(userSessKey(s.User), s.ID)
+}
+
+// userSessions : live sessions of the user, latest first
+func userSessions(cache *auth.TokenCache, email string) ([]*Session, error) {
+	ids, err := cache.SMembers(userSessKey(email)).Result()
+	if err != nil {
+		return nil, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to get sessions", "userSessions")
+	}
+	result := []*Session{}
+	for _, id := range ids {
+		s, err := getSession(cache, id)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			cache.SRem(userSessKey(email), id) // lapsed
+			continue
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Refreshed.After(result[j].Refreshed) })
+	return result, nil
+}
+
+// revokeSessions : ends the sessions, returns the count ended
+func revokeSessions(cache *auth.TokenCache, sessions []*Session) (int, error) {
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+	if _, err := cache.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, s := range sessions {
+			endSession(pipe, s)
+		}
+		return nil
+	}); err != nil {
+		return 0, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to revoke sessions", "revokeSessions")
+	}
+	return len(sessions), nil
+}
+
+// logoutSession : logout with the token ends the session it belongs to
+// tokens from before there were sessions are logged out on their own
+func logoutSession(cache *auth.TokenCache, tok *auth.JWTok) error {
+	id, err := tokenSession(cache, tok)
+	if err != nil {
+		return err
+	}
+	var s *Session
+	if id != "" {
+		if s, err = getSession(cache, id); err != nil {
+			return err
+		}
+	}
+	if s == nil {
+		return cache.LogoutToken(tok)
+	}
+	_, err = revokeSessions(cache, []*Session{s})
+	return err
+}
+
+// HandlSessions : sessions of the user, the user and the admins can list and revoke them
+// GET /users/:email/sessions lists the live sessions
+// DELETE /users/:email/sessions logs out everywhere, ?others=true keeps the session making the request
+// DELETE /users/:email/sessions/:id revokes the one session
+func HandlSessions(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	cache, cacClose := getTknCacFromCtx(c)
+	if cache == nil {
+		return
+	}
+	defer cacClose()
+	tok := getTknFromCtx(c)
+	if tok == nil {
+		return
+	}
+	email := c.Param("email")
+	sessions, err := userSessions(cache, email)
+	if DigestErr(err, c) != 0 {
+		return
+	}
+	for _, s := range sessions {
+		s.Current = s.authUUID == tok.UUID
+	}
+	if c.Request.Method == "GET" {
+		c.JSON(http.StatusOK, sessions)
+		return
+	} else if c.Request.Method == "DELETE" {
+		revoke := []*Session{}
+		if id := c.Param("id"); id != "" {
+			for _, s := range sessions {
+				if s.ID == id {
+					revoke = append(revoke, s)
+				}
+			}
+			if len(revoke) == 0 {
+				DigestErr(ex.NewErr(&ex.ErrNotFound{}, fmt.Errorf("no session %s for %s", id, email), "No such session, it may have ended already", "HandlSessions/DELETE"), c)
+				return
+			}
+		} else {
+			for _, s := range sessions {
+				if !(s.Current && c.Query("others") == "true") {
+					revoke = append(revoke, s)
+				}
+			}
+		}
+		count, err := revokeSessions(cache, revoke)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"revoked": count})
+		return
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+// Requests that are held open - event streams, websockets, command long-polls - and the server shutting down
+// the server's write timeout would cut these short, they push the deadline on the connection out themselves
+// on shutdown they are let go of right away, the clients reconnect to whichever instance is up
+// bulk jobs running in the background are waited on, those that do not complete in time are recorded as interrupted
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type connCtxKey struct{}
+
+var (
+	draining  = make(chan struct{})
+	drainOnce sync.Once
+	// bulk jobs running in the background, and the signal for them to stop
+	bulkJobs     sync.WaitGroup
+	bulkStop     = make(chan struct{})
+	bulkStopOnce sync.Once
+)
+
+// ConnContext : for http.Server.ConnContext, puts the connection on the request context
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connCtxKey{}, conn)
+}
+
+// Drain : the server is shutting down, requests held open return
+// for http.Server.RegisterOnShutdown, safe to call more than once
+func Drain() {
+	drainOnce.Do(func() { close(draining) })
+}
+
+// WaitBulkJobs : waits for the bulk jobs running in the background till ctx is done
+// jobs still running then stop before their next device and are marked interrupted, the error is that of ctx
+func WaitBulkJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		bulkJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	bulkStopOnce.Do(func() { close(bulkStop) })
+	<-done
+	return ctx.Err()
+}
+
+// extendWriteDeadline : the response can be written for d from now, zero for no deadline
+// no-op when the server did not put the connection on the context
+func extendWriteDeadline(c *gin.Context, d time.Duration) {
+	conn, ok := c.Request.Context().Value(connCtxKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	if d == 0 {
+		conn.SetWriteDeadline(time.Time{})
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(d))
+}
@@ -0,0 +1,253 @@
+package handlers
+
+// Live stream of the events for dashboards, over server sent events or websocket
+// the bus publishes every event on redis, each stream subscribes and sends on what the token is allowed to see
+// streams end when the token expires, or when the account changes or the session ends, clients reconnect with a fresh token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	evChannel    = "authapi:events" // redis channel the bus publishes on
+	streamKeepAl = 15 * time.Second // sse comment / websocket ping so that proxies do not cut the stream
+	streamWrite  = 10 * time.Second // each write on the stream has this long, a client that stopped reading is let go of
+	streamCheck  = 30 * time.Second // the token is checked again this often, revoking it ends the stream within this
+)
+
+// WSOriginAllowed : browsers do not preflight websockets, the origins are checked on the upgrade against the cors origins
+// set up by main, any origin when not
+var WSOriginAllowed = func(origin string) bool { return true }
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true // devices and scripts do not send an origin
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true // same origin, as with the cors origins left empty
+		}
+		return WSOriginAllowed(origin)
+	},
+}
+
+// eventVisible : admins see all the events, everyone else only the events on their account and devices
+func eventVisible(tok *auth.JWTok, ev *Event) bool {
+	return tok.HasElevation(2) || (ev.Owner != "" && ev.Owner == tok.User)
+}
+
+// tokenExpiry : time at which the token expires, read off the claims
+func tokenExpiry(tok *auth.JWTok) time.Time {
+	if tok.Token != nil {
+		if claims, ok := tok.Claims.(jwt.MapClaims); ok {
+			if exp, ok := claims["exp"].(float64); ok {
+				return time.Unix(int64(exp), 0)
+			}
+		}
+	}
+	return time.Now().Add(auth.AuthExp)
+}
+
+// eventStream : subscription to the events visible to the token
+// ?events=device.locked,device.unlocked narrows down to the kinds of events
+type eventStream struct {
+	pubsub *redis.PubSub
+	tok    *auth.JWTok
+	kinds  map[string]bool
+}
+
+// openEventStream : subscribes on the cache from the context, digests the error if it cannot
+func openEventStream(c *gin.Context, cache *auth.TokenCache) *eventStream {
+	es := &eventStream{tok: getTknFromCtx(c), kinds: map[string]bool{}}
+	if q := c.Query("events"); q != "" {
+		for _, k := range strings.Split(q, ",") {
+			if !eventKinds[k] {
+				DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Unknown event %s", k), "openEventStream"), c)
+				return nil
+			}
+			es.kinds[k] = true
+		}
+	}
+	es.pubsub = cache.Subscribe(evChannel)
+	if _, err := es.pubsub.Receive(); err != nil {
+		es.pubsub.Close()
+		DigestErr(ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to subscribe to events", "openEventStream/Subscribe"), c)
+		return nil
+	}
+	return es
+}
+
+// authorized : token is still of the current generation and its session has not ended
+// a failure to check ends the stream too, the client reconnects and gets the error on the request
+func (es *eventStream) authorized() bool {
+	current, err := TokenCurrent(es.tok)
+	if err != nil || !current {
+		return false
+	}
+	live, err := TokenLive(es.tok)
+	return err == nil && live
+}
+
+// next : reads the message as event, nil if the event is not for this stream
+func (es *eventStream) next(msg *redis.Message) *Event {
+	ev := &Event{}
+	if err := json.Unmarshal([]byte(msg.Payload), ev); err != nil {
+		log.Warnf("eventStream: failed to read event %s", err)
+		return nil
+	}
+	if !eventVisible(es.tok, ev) || (len(es.kinds) > 0 && !es.kinds[ev.Kind] && !es.kinds[evAny]) {
+		return nil
+	}
+	return ev
+}
+
+// HandlEventStream : server sent events, each event is sent with its kind as the sse event name
+func HandlEventStream(c *gin.Context) {
+	cache, cacClose := getTknCacFromCtx(c)
+	if cache == nil {
+		return
+	}
+	defer cacClose()
+	es := openEventStream(c, cache)
+	if es == nil {
+		return
+	}
+	defer es.pubsub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // nginx otherwise buffers the stream
+	c.Status(http.StatusOK)
+	extendWriteDeadline(c, streamWrite)
+	c.Writer.Flush()
+
+	expired := time.NewTimer(time.Until(tokenExpiry(es.tok)))
+	defer expired.Stop()
+	keepAlive := time.NewTicker(streamKeepAl)
+	defer keepAlive.Stop()
+	recheck := time.NewTicker(streamCheck)
+	defer recheck.Stop()
+	msgs := es.pubsub.Channel()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-draining:
+			return // EventSource reconnects on its own
+		case <-expired.C:
+			extendWriteDeadline(c, streamWrite)
+			fmt.Fprint(c.Writer, "event: expired\ndata: {}\n\n")
+			c.Writer.Flush()
+			return
+		case <-recheck.C:
+			if !es.authorized() {
+				extendWriteDeadline(c, streamWrite)
+				fmt.Fprint(c.Writer, "event: revoked\ndata: {}\n\n")
+				c.Writer.Flush()
+				return
+			}
+		case <-keepAlive.C:
+			extendWriteDeadline(c, streamWrite)
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if ev := es.next(msg); ev != nil {
+				body, _ := json.Marshal(ev)
+				extendWriteDeadline(c, streamWrite)
+				fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Kind, body)
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// HandlEventSocket : same events as HandlEventStream but as json messages over a websocket
+// the socket is closed with policy violation once the token expires or is revoked
+func HandlEventSocket(c *gin.Context) {
+	cache, cacClose := getTknCacFromCtx(c)
+	if cache == nil {
+		return
+	}
+	defer cacClose()
+	es := openEventStream(c, cache)
+	if es == nil {
+		return
+	}
+	defer es.pubsub.Close()
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// upgrader has already responded with the error
+		Logger(c).Warnf("HandlEventSocket: failed to upgrade connection %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// the client isnt expected to send anything, reading is only to know when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	expired := time.NewTimer(time.Until(tokenExpiry(es.tok)))
+	defer expired.Stop()
+	keepAlive := time.NewTicker(streamKeepAl)
+	defer keepAlive.Stop()
+	recheck := time.NewTicker(streamCheck)
+	defer recheck.Stop()
+	msgs := es.pubsub.Channel()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-draining:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			return
+		case <-expired.C:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"), time.Now().Add(time.Second))
+			return
+		case <-recheck.C:
+			if !es.authorized() {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked"), time.Now().Add(time.Second))
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if ev := es.next(msg); ev != nil {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteJSON(ev); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+// Tokens issued on login and refresh - how long they live and what goes on them
+// auth.TokenCache.LoginUser has the lifetimes fixed, the tokens are issued here instead and put on the cache the same way
+// so that TokenStatus and LogoutToken from the auth library work on them as before
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+)
+
+// TokenTTL : lifetimes of the access and the refresh token, zero when not set
+type TokenTTL struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+// TokenPolicy : lifetimes by the role and the client, sliding sessions and the claims
+type TokenPolicy struct {
+	Default TokenTTL
+	// the role overrides the default, the client can only shorten that - the client type is what the app says it is
+	Roles   map[int]TokenTTL
+	Clients map[string]TokenTTL
+	// lifetime of the tokens issued to the devices
+	Device time.Duration
+	// refreshing extends the session by the refresh lifetime, else the session ends when the first refresh token would have
+	Sliding bool
+	// no session lives beyond this from the login, 0 for no limit
+	MaxSession time.Duration
+	// claims on the tokens when set - org, perms for the role, and sid the session id
+	Org          string
+	Permissions  map[int][]string
+	SessionClaim bool
+}
+
+// Tokens : policy the tokens are issued with, set up by main
+var Tokens = &TokenPolicy{Default: TokenTTL{Access: auth.AuthExp, Refresh: auth.RefrExp}, Device: DeviceTokExp, Sliding: true}
+
+// clientHeader : apps say what kind of client they are, web when they do not
+// nothing verifies the header, so it can only get the app shorter lifetimes than the role would
+const clientHeader = "X-Client-Type"
+
+var clientTypes = map[string]bool{"web": true, "mobile": true}
+
+// clientType : kind of client from the request header
+func clientType(c *gin.Context) (string, error) {
+	client := c.GetHeader(clientHeader)
+	if client == "" {
+		return "web", nil
+	}
+	if !clientTypes[client] {
+		return "", ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("unknown client type %s", client), fmt.Sprintf("%s can be web or mobile", clientHeader), "clientType")
+	}
+	return client, nil
+}
+
+// shorter : the lesser of the durations that are set, 0 when neither is
+func shorter(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// ttl : lifetimes for the role, defaults where the role sets none, shortened by the client where it sets one
+func (tp *TokenPolicy) ttl(role int, client string) TokenTTL {
+	result, cl := tp.Roles[role], tp.Clients[client]
+	if result.Access == 0 {
+		result.Access = tp.Default.Access
+	}
+	if result.Refresh == 0 {
+		result.Refresh = tp.Default.Refresh
+	}
+	return TokenTTL{Access: shorter(result.Access, cl.Access), Refresh: shorter(result.Refresh, cl.Refresh)}
+}
+
+// deviceExp : lifetime of the device tokens, DeviceTokExp when not set
+func (tp *TokenPolicy) deviceExp() time.Duration {
+	if tp.Device == 0 {
+		return DeviceTokExp
+	}
+	return tp.Device
+}
+
+// lifetimes : of the tokens issued on the session now, on login the session is just created
+// the refresh token does not outlive the session, nor the access token the refresh token
+func (tp *TokenPolicy) lifetimes(s *Session, now time.Time) (TokenTTL, error) {
+	ttl := tp.ttl(s.Role, s.Client)
+	end := now.Add(ttl.Refresh)
+	if !tp.Sliding && !s.Expires.IsZero() && s.Expires.Before(end) {
+		end = s.Expires // refreshing does not extend the session, it ends when the first refresh token would have
+	}
+	if tp.MaxSession > 0 && s.Created.Add(tp.MaxSession).Before(end) {
+		end = s.Created.Add(tp.MaxSession)
+	}
+	left := end.Sub(now).Truncate(time.Second)
+	if left <= 0 {
+		return TokenTTL{}, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("session %s has run its course", s.ID), "Session has ended, please sign in again", "TokenPolicy.lifetimes")
+	}
+	return TokenTTL{Access: shorter(ttl.Access, left), Refresh: left}, nil
+}
+
+// claims : on top of user, role, uuid and exp that the auth library puts on the tokens
+func (tp *TokenPolicy) claims(s *Session, gen int64) jwt.MapClaims {
+	result := jwt.MapClaims{genClaim: gen}
+	if tp.Org != "" {
+		result["org"] = tp.Org
+	}
+	if perms, ok := tp.Permissions[s.Role]; ok {
+		result["perms"] = perms
+	}
+	if tp.SessionClaim {
+		result["sid"] = s.ID
+	}
+	return result
+}
+
+// issueTokens : new pair of tokens on the session, gen is the generation of the account they are issued in
+// the session's expiry moves to that of the refresh token, saveSession puts the tokens on the cache
+func issueTokens(s *Session, gen int64) (*auth.TokenPair, error) {
+	now := time.Now()
+	ttl, err := Tokens.lifetimes(s, now)
+	if err != nil {
+		return nil, err
+	}
+	pair := &auth.TokenPair{Auth: auth.NewToken(s.User, s.Role, ttl.Access), Refr: auth.NewToken(s.User, s.Role, ttl.Refresh)}
+	claims := Tokens.claims(s, gen)
+	for _, tok := range []*auth.JWTok{pair.Auth, pair.Refr} {
+		mc := tok.Claims.(jwt.MapClaims)
+		for k, v := range claims {
+			mc[k] = v
+		}
+	}
+	s.authUUID, s.refrUUID, s.Expires = pair.Auth.UUID, pair.Refr.UUID, now.Add(ttl.Refresh)
+	return pair, nil
+}
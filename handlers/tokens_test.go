@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTokenLifetimes : overrides by the role and the client, sliding and fixed sessions, the session limit
+func TestTokenLifetimes(t *testing.T) {
+	tp := &TokenPolicy{
+		Default: TokenTTL{Access: time.Minute, Refresh: time.Hour},
+		Roles:   map[int]TokenTTL{2: {Access: 5 * time.Minute, Refresh: 2 * time.Hour}},
+		Clients: map[string]TokenTTL{"mobile": {Access: 30 * time.Second, Refresh: 30 * 24 * time.Hour}},
+		Sliding: true,
+	}
+	assert.Equal(t, TokenTTL{Access: time.Minute, Refresh: time.Hour}, tp.ttl(0, "web"), "defaults when nothing overrides")
+	assert.Equal(t, TokenTTL{Access: 30 * time.Second, Refresh: time.Hour}, tp.ttl(0, "mobile"), "client only shortens")
+	assert.Equal(t, TokenTTL{Access: 30 * time.Second, Refresh: 2 * time.Hour}, tp.ttl(2, "mobile"), "role overrides, the client shortens")
+	assert.Equal(t, DeviceTokExp, tp.deviceExp(), "device tokens when not set")
+
+	login := time.Now()
+	s := &Session{ID: "s1", Role: 0, Client: "web", Created: login}
+	ttl, err := tp.lifetimes(s, login)
+	assert.Nil(t, err)
+	assert.Equal(t, TokenTTL{Access: time.Minute, Refresh: time.Hour}, ttl)
+	s.Expires = login.Add(ttl.Refresh)
+
+	// sliding, refreshing extends the session
+	ttl, err = tp.lifetimes(s, login.Add(50*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, ttl.Refresh)
+
+	// fixed, the refresh token does not outlive the first one
+	tp.Sliding = false
+	ttl, err = tp.lifetimes(s, login.Add(50*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, ttl.Refresh)
+	assert.Equal(t, time.Minute, ttl.Access)
+	ttl, err = tp.lifetimes(s, login.Add(59*time.Minute+30*time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, ttl.Access, "access token does not outlive the refresh token")
+	_, err = tp.lifetimes(s, login.Add(time.Hour))
+	assert.NotNil(t, err, "session has run its course")
+
+	// sliding up to the limit
+	tp.Sliding, tp.MaxSession = true, 90*time.Minute
+	ttl, err = tp.lifetimes(s, login.Add(50*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 40*time.Minute, ttl.Refresh)
+	_, err = tp.lifetimes(s, login.Add(90*time.Minute))
+	assert.NotNil(t, err)
+}
+
+// TestTokenClaims : claims are on both the tokens and only when set up
+func TestTokenClaims(t *testing.T) {
+	defer func(tp *TokenPolicy) { Tokens = tp }(Tokens)
+	Tokens = &TokenPolicy{Default: TokenTTL{Access: time.Minute, Refresh: time.Hour}, Sliding: true}
+	s := &Session{ID: "s1", User: "someone@gmail.com", Role: 1, Client: "web", Created: time.Now()}
+	pair, err := issueTokens(s, 3)
+	assert.Nil(t, err)
+	claims := pair.Auth.Claims.(jwt.MapClaims)
+	assert.Equal(t, int64(3), claims[genClaim])
+	for _, k := range []string{"org", "perms", "sid"} {
+		_, ok := claims[k]
+		assert.False(t, ok, "%s claim when not set up", k)
+	}
+	assert.Equal(t, pair.Auth.UUID, s.authUUID)
+	assert.Equal(t, pair.Refr.UUID, s.refrUUID)
+
+	Tokens.Org, Tokens.SessionClaim = "eensymachines", true
+	Tokens.Permissions = map[int][]string{1: {"devices:write"}}
+	pair, err = issueTokens(s, 3)
+	assert.Nil(t, err)
+	for _, tok := range []*jwt.Token{pair.Auth.Token, pair.Refr.Token} {
+		claims := tok.Claims.(jwt.MapClaims)
+		assert.Equal(t, "eensymachines", claims["org"])
+		assert.Equal(t, []string{"devices:write"}, claims["perms"])
+		assert.Equal(t, "s1", claims["sid"])
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+// Token generations - each account has a generation number that is stamped on the tokens issued to it
+// deleting the account, changing its role or its password bumps the generation
+// tokens carrying an older generation are refused right away instead of living on till they expire
+
+import (
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+	auth "github.com/eensymachines-in/auth/v2"
+	ex "github.com/eensymachines-in/errx"
+	"github.com/go-redis/redis/v7"
+)
+
+// genClaim : claim on the token that carries the generation, tokens from before there were generations are of generation 0
+const genClaim = "gen"
+
+// TokenGenerations : generation of the tokens for each account, kept on the cache
+type TokenGenerations struct {
+	cache *redis.Client
+}
+
+// TokenGens : generations checked when parsing the tokens, set up by main
+// when nil all the tokens are of generation 0 and nothing is revoked
+var TokenGens *TokenGenerations
+
+// NewTokenGenerations : generations on the cache that the tokens are on
+func NewTokenGenerations(cache *redis.Client) *TokenGenerations {
+	return &TokenGenerations{cache: cache}
+}
+
+// tokGenKey : does not expire, the generation going back to 0 would let the tokens issued before through
+func tokGenKey(email string) string {
+	return fmt.Sprintf("tokgen:%s", email)
+}
+
+// Current : generation of the tokens issued to the account now
+func (tg *TokenGenerations) Current(email string) (int64, error) {
+	if tg == nil {
+		return 0, nil
+	}
+	gen, err := tg.cache.Get(tokGenKey(email)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, ex.NewErr(&ex.ErrCacheQuery{}, err, "Failed to verify authorization", "TokenGenerations.Current")
+	}
+	return gen, nil
+}
+
+// Bump : tokens issued to the account so far are no good, the sessions of the account are ended too
+// call after the account has changed, a login in between would otherwise get tokens of the new generation with the old role
+func (tg *TokenGenerations) Bump(email string) error {
+	if tg == nil {
+		return nil
+	}
+	if err := tg.cache.Incr(tokGenKey(email)).Err(); err != nil {
+		return ex.NewErr(&ex.ErrCacheQuery{}, err, "Account changed but failed to sign it out, please try again", "TokenGenerations.Bump")
+	}
+	cache := &auth.TokenCache{Client: tg.cache}
+	sessions, err := userSessions(cache, email)
+	if err != nil {
+		return err
+	}
+	_, err = revokeSessions(cache, sessions)
+	return err
+}
+
+// tokenGen : generation the token was issued in, numbers in the claims are float64 once parsed
+func tokenGen(tok *auth.JWTok) int64 {
+	if tok.Token != nil {
+		if claims, ok := tok.Claims.(jwt.MapClaims); ok {
+			if gen, ok := claims[genClaim].(float64); ok {
+				return int64(gen)
+			}
+		}
+	}
+	return 0
+}
+
+// TokenCurrent : the token was issued after the account last changed
+func TokenCurrent(tok *auth.JWTok) (bool, error) {
+	gen, err := TokenGens.Current(tok.User)
+	if err != nil {
+		return false, err
+	}
+	return tokenGen(tok) == gen, nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+// Tracing with opentelemetry, the provider and the exporter are set up by main
+// request spans come from the middleware, store calls get their own spans under the request span
+// redis calls are traced by the hook on the client, mgo has no hooks so the calls are wrapped in traceCall
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer : the tracer for all the spans of the api
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/eensymachines-in/authapi")
+}
+
+// StartSpan : span under the request span, the request context is replaced so that later spans nest under this one
+// call the returned func to end the span
+func StartSpan(c *gin.Context, name string, attrs ...attribute.KeyValue) (trace.Span, func()) {
+	parent := c.Request.Context()
+	ctx, span := Tracer().Start(parent, name, trace.WithAttributes(attrs...))
+	c.Request = c.Request.WithContext(ctx)
+	return span, func() {
+		span.End()
+		c.Request = c.Request.WithContext(parent)
+	}
+}
+
+// endSpan : records the error on the span before ending it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceCall : runs the store call in a span of its own
+// name is the store and the call - mongo.AccountDetails, bcrypt.Authenticate
+// calls to mongo and redis are timed for the metrics too, the call is the op
+func traceCall(c *gin.Context, name string, call func() error) error {
+	parts := strings.SplitN(name, ".", 2)
+	system := parts[0]
+	_, span := Tracer().Start(c.Request.Context(), name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.DBSystemKey.String(system)))
+	start := time.Now()
+	err := call()
+	if len(parts) == 2 && (system == "mongo" || system == "redis") {
+		ObserveStore(system, parts[1], time.Since(start))
+	}
+	endSpan(span, err)
+	return err
+}
+
+// redisStart : context key for when the redis command was sent
+type redisStart struct{}
+
+// RedisTracing : hook for the redis clients, a client span for each command and pipeline, timed for the metrics
+// spans nest under the request only when the client is given the request context - client.WithContext()
+type RedisTracing struct{}
+
+// BeforeProcess : starts the span for the command
+func (RedisTracing) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	ctx, _ = Tracer().Start(ctx, "redis."+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperationKey.String(cmd.Name())))
+	return context.WithValue(ctx, redisStart{}, time.Now()), nil
+}
+
+// AfterProcess : ends the span for the command, redis.Nil is not an error
+func (RedisTracing) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	err := cmd.Err()
+	if err == redis.Nil {
+		err = nil
+	}
+	if start, ok := ctx.Value(redisStart{}).(time.Time); ok {
+		ObserveStore("redis", cmd.Name(), time.Since(start))
+	}
+	endSpan(trace.SpanFromContext(ctx), err)
+	return nil
+}
+
+// BeforeProcessPipeline : one span for the whole pipeline
+func (RedisTracing) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.Name()
+	}
+	ctx, _ = Tracer().Start(ctx, "redis.pipeline", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperationKey.String(strings.Join(names, " "))))
+	return context.WithValue(ctx, redisStart{}, time.Now()), nil
+}
+
+// AfterProcessPipeline : ends the pipeline span with the first error in there
+func (RedisTracing) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if e := cmd.Err(); e != nil && e != redis.Nil {
+			err = e
+			break
+		}
+	}
+	if start, ok := ctx.Value(redisStart{}).(time.Time); ok {
+		ObserveStore("redis", "pipeline", time.Since(start))
+	}
+	endSpan(trace.SpanFromContext(ctx), err)
+	return nil
+}
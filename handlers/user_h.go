@@ -3,12 +3,12 @@ package handlers
 // All the user route handlers here
 import (
 	"fmt"
-	"log"
 	"net/http"
 
 	auth "github.com/eensymachines-in/auth/v2"
 	ex "github.com/eensymachines-in/errx"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func bindToUserAcc(c *gin.Context, result interface{}) error {
@@ -34,6 +34,29 @@ func bindToUserAcc(c *gin.Context, result interface{}) error {
 	return nil
 }
 
+// usrSortable : sort keys from the query mapped to the fields in userreg, created date is from the object id
+var usrSortable = map[string]string{"name": "name", "email": "email", "created": "_id"}
+
+// usrListFilter : reads the filters for enlisting the user accounts
+// role and location are matched whole while q is free text search on the name
+func usrListFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+	role, ok, err := intQuery(c, "role")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		filter["role"] = role
+	}
+	if loc := c.Query("loc"); loc != "" {
+		filter["loc"] = regexQ(loc, true)
+	}
+	if q := c.Query("q"); q != "" {
+		filter["name"] = regexQ(q, false)
+	}
+	return filter, nil
+}
+
 // HandlUsrDevices : for user the devices this serves as route handelr
 func HandlUsrDevices(c *gin.Context) {
 	closeSession, _ := c.Get("close_session")
@@ -43,12 +66,30 @@ func HandlUsrDevices(c *gin.Context) {
 	email := c.Param("email")
 	if c.Request.Method == "GET" {
 		// trying to get all the devices of a certain user
+		if labels := c.QueryArray("label"); len(labels) > 0 {
+			// /users/:email/devices?label=porch : only the devices with all the labels
+			// labels are the owner's metadata, so are they to filter on
+			if !ownerOrAdmin(c, email) {
+				DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("labels of the devices of %s asked for without the token of the owner", email), "Only the owner of the devices can filter on the labels", "HandlUsrDevices/label"), c)
+				return
+			}
+			stati := []deviceListing{}
+			if err := dr.Find(bson.M{"user": email, "meta.labels": bson.M{"$all": labels}}).All(&stati); err != nil {
+				DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get user devices, gateway failed", "HandlUsrDevices/dr.Find().All()"), c)
+				return
+			}
+			for i := range stati {
+				stati[i].Registered = stati[i].ID.Time()
+			}
+			c.JSON(http.StatusOK, stati)
+			return
+		}
 		stati, err := dr.FindUserDevices(email)
 		if err != nil {
-			ex.DigestErr(err, c)
+			DigestErr(err, c)
 			return
 		}
-		log.Printf("user devices %v", stati)
+		Logger(c).Debugf("%d devices of the user", len(stati))
 		c.JSON(http.StatusOK, stati)
 		return
 	}
@@ -63,22 +104,38 @@ func HndlUsers(c *gin.Context) {
 	if c.Request.Method == "POST" {
 		// post request works on not the specific account but list of all accounts
 		ud := &auth.UserAccDetails{}
-		if ex.DigestErr(bindToUserAcc(c, ud), c) != 0 {
+		if DigestErr(bindToUserAcc(c, ud), c) != 0 {
 			return
 		}
-		if ex.DigestErr(ua.InsertAccount(ud), c) != 0 {
+		if DigestErr(ua.InsertAccount(ud), c) != 0 {
 			// log.Infof("just to log the account details %v", *ud)
 			return
 		}
+		Events.Publish(EvUserCreated, ud.Email, gin.H{"email": ud.Email, "name": ud.Name, "role": ud.Role})
 		c.AbortWithStatus(http.StatusOK)
 		return
 	} else if c.Request.Method == "GET" {
-		result := []auth.UserAccDetails{}
-		// in one large dump this will pick the user accounts and dispatch them to the result
-		// we need to add this new Enlist function in auth package
-		if ex.DigestErr(ua.Enlist(&result), c) != 0 {
+		// /users?role=1&loc=pune&q=niranjan&sort=-created&limit=20&cursor=<from Link header>
+		pr, err := readPageReq(c, usrSortable, "email")
+		if DigestErr(err, c) != 0 {
 			return
 		}
+		filter, err := usrListFilter(c)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		docs, next, total, err := findPage(ua.Collection, filter, pr)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		result := make([]auth.UserAccDetails, len(docs))
+		for i, d := range docs {
+			if err := bsonTo(d, &result[i]); err != nil {
+				DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to read user accounts", "HndlUsers/bsonTo"), c)
+				return
+			}
+		}
+		setPageHeaders(c, next, total)
 		c.JSON(http.StatusOK, result)
 		return
 	}
@@ -95,7 +152,7 @@ func HandlUser(c *gin.Context) {
 	if c.Request.Method == "GET" {
 		// Getting details of the user account
 		details, err := ua.AccountDetails(email)
-		if ex.DigestErr(err, c) != 0 {
+		if DigestErr(err, c) != 0 {
 			return
 		}
 		c.JSON(http.StatusOK, details)
@@ -103,36 +160,54 @@ func HandlUser(c *gin.Context) {
 	} else if c.Request.Method == "DELETE" {
 		details, err := ua.AccountDetails(email)
 		if err != nil {
-			ex.DigestErr(err, c)
+			DigestErr(err, c)
 			return
 		}
 		if details.Role < 2 {
 			// Only if the user account is not of an admin
 			// admin accounts cannot be deleted
+			if c.Query("erase") == "true" {
+				// /users/:email?erase=true : personal data is wiped, device trail is retained under a pseudonym
+				if DigestErr(eraseAccount(c, ua, email), c) != 0 {
+					return
+				}
+				if DigestErr(TokenGens.Bump(email), c) != 0 {
+					return
+				}
+				// the email is gone from the records, the event names the account by its pseudonym
+				Events.Publish(EvUserDeleted, pseudonym(email), gin.H{"email": pseudonym(email), "erased": true})
+				c.Set("audit_target", pseudonym(email))
+				c.AbortWithStatus(http.StatusOK)
+				return
+			}
 			val, _ := c.Get("devreg") // getting to the devreg collection
 			devreg := val.(*auth.DeviceRegColl)
 			devices, err := devreg.FindUserDevices(email)
-			if ex.DigestErr(err, c) != 0 {
+			if DigestErr(err, c) != 0 {
 				return
 			}
 			// If a user account is deleted - all the owned devices shall be blacklisted and their registrations would be deleted
 			val, _ = c.Get("devblacklist")
 			blckL := val.(*auth.BlacklistColl)
 			for _, d := range devices {
-				if ex.DigestErr(blckL.Black(&auth.Blacklist{Serial: d.Serial, Reason: "Account deleted, device is blacklisted"}), c) != 0 {
+				if DigestErr(blckL.Black(&auth.Blacklist{Serial: d.Serial, Reason: "Account deleted, device is blacklisted"}), c) != 0 {
 					return
 				}
-				if ex.DigestErr(devreg.RemoveDeviceReg(d.Serial), c) != 0 {
+				if DigestErr(devreg.RemoveDeviceReg(d.Serial), c) != 0 {
 					return
 				}
 			}
-			if ex.DigestErr(ua.RemoveAccount(email), c) != 0 {
+			if DigestErr(ua.RemoveAccount(email), c) != 0 {
+				return
+			}
+			if DigestErr(TokenGens.Bump(email), c) != 0 {
 				return
 			}
+			Events.Publish(EvUserDeleted, email, gin.H{"email": email, "erased": false})
 			c.AbortWithStatus(http.StatusOK)
 			return
 		}
-		ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Trying to delete admin account %s", email), "Admin accounts are immune to deletion, will not proceed", "HandlUser/DEL"), c)
+		DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Trying to delete admin account %s", email), "Admin accounts are immune to deletion, will not proceed", "HandlUser/DEL"), c)
 		return
 
 	} else if c.Request.Method == "PUT" {
@@ -141,10 +216,10 @@ func HandlUser(c *gin.Context) {
 		// to change the password use the patch verb
 		newDetails := &auth.UserAccDetails{}
 		if c.ShouldBindJSON(newDetails) != nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrJSONBind{}, fmt.Errorf("Failed to read account details to be updated"), "Invalid account details to alter, check and send again", "HandlUser/PUT"), c)
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, fmt.Errorf("Failed to read account details to be updated"), "Invalid account details to alter, check and send again", "HandlUser/PUT"), c)
 			return
 		}
-		if ex.DigestErr(ua.UpdateAccDetails(newDetails), c) != 0 {
+		if DigestErr(ua.UpdateAccDetails(newDetails), c) != 0 {
 			return
 		}
 		c.AbortWithStatus(http.StatusOK)
@@ -154,7 +229,59 @@ func HandlUser(c *gin.Context) {
 		userEmail, _ := c.Get("email")
 		passwd, _ := c.Get("passwd") // we have extracted the email
 		accPatch := &auth.UserAcc{Email: fmt.Sprintf("%v", userEmail), Passwd: fmt.Sprintf("%v", passwd)}
-		if ex.DigestErr(ua.UpdateAccPasswd(accPatch), c) != 0 {
+		if DigestErr(ua.UpdateAccPasswd(accPatch), c) != 0 {
+			return
+		}
+		// signed out everywhere, whoever had the old password cannot carry on with the tokens
+		if DigestErr(TokenGens.Bump(accPatch.Email), c) != 0 {
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+}
+
+// roleChange : body of the request to change the role of an account
+type roleChange struct {
+	Role *int `json:"role" binding:"required"`
+}
+
+// HandlUserRole : admins change the role of an account, 0 user 1 elevated user 2 admin
+// admin accounts are immune here as they are to deletion
+// tokens issued with the old role are revoked, the user has to sign in again
+func HandlUserRole(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	userreg, _ := c.Get("userreg")
+	ua, _ := userreg.(*auth.UserAccounts)
+	email := c.Param("email")
+	if c.Request.Method == "PUT" {
+		rc := &roleChange{}
+		if err := c.ShouldBindJSON(rc); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read the role to change to", "HandlUserRole/PUT"), c)
+			return
+		}
+		if *rc.Role < 0 || *rc.Role > 2 {
+			DigestErr(ex.NewErr(&ex.ErrInvalid{}, fmt.Errorf("role %d out of range", *rc.Role), "Role can be 0, 1 or 2", "HandlUserRole/PUT"), c)
+			return
+		}
+		details, err := ua.AccountDetails(email)
+		if DigestErr(err, c) != 0 {
+			return
+		}
+		if details.Role >= 2 {
+			DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Trying to change the role of admin account %s", email), "Admin accounts are immune to role changes, will not proceed", "HandlUserRole/PUT"), c)
+			return
+		}
+		if details.Role == *rc.Role {
+			c.AbortWithStatus(http.StatusOK) // no change, the tokens stay
+			return
+		}
+		if err := ua.Update(bson.M{"email": email}, bson.M{"$set": bson.M{"role": *rc.Role}}); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to change the role, server gateway failed", "HandlUserRole/ua.Update()"), c)
+			return
+		}
+		if DigestErr(TokenGens.Bump(email), c) != 0 {
 			return
 		}
 		c.AbortWithStatus(http.StatusOK)
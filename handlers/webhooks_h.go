@@ -0,0 +1,314 @@
+package handlers
+
+// Webhooks let other services know of events instead of polling the api
+// each event is queued as one delivery per matching subscription and the dispatcher posts them with retries
+// the receiver verifies X-Authapi-Signature: sha256=hex(hmac(secret, timestamp.body)) with the timestamp from X-Authapi-Timestamp
+// and refuses deliveries with a timestamp too far off, so that a captured delivery cannot be replayed later
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	ex "github.com/eensymachines-in/errx"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	whMaxAttempts = 8
+	whBaseBackoff = 30 * time.Second
+	whMaxBackoff  = time.Hour
+	whLogLimit    = 100
+	// whLease : delivery claimed by a dispatcher is left to it this long, then another can take it up
+	whLease = 2 * time.Minute
+)
+
+// WebhookSub : subscription of a receiver to the events
+type WebhookSub struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	URL     string        `json:"url" bson:"url"`
+	Events  []string      `json:"events" bson:"events"` // * for all the events
+	Secret  string        `json:"secret,omitempty" bson:"secret"`
+	Active  bool          `json:"active" bson:"active"`
+	Created time.Time     `json:"created" bson:"created"`
+}
+
+// validate : url has to be absolute http(s) and the events known
+func (ws *WebhookSub) validate() error {
+	u, err := url.Parse(ws.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ex.NewErr(&ex.ErrInvalid{}, err, "Webhook url has to be an absolute http/https url", "WebhookSub.validate/url")
+	}
+	if len(ws.Events) == 0 {
+		return ex.NewErr(&ex.ErrInvalid{}, nil, "Webhook has to subscribe to at least one event", "WebhookSub.validate/events")
+	}
+	for _, e := range ws.Events {
+		if !eventKinds[e] {
+			return ex.NewErr(&ex.ErrInvalid{}, nil, fmt.Sprintf("Unknown event %s", e), "WebhookSub.validate/events")
+		}
+	}
+	return nil
+}
+
+// DeliveryAttempt : one try at posting the event to the receiver
+type DeliveryAttempt struct {
+	At     time.Time `json:"at" bson:"at"`
+	Status int       `json:"status" bson:"status"` // 0 when the receiver could not be reached
+	Error  string    `json:"error,omitempty" bson:"error,omitempty"`
+	Took   int64     `json:"took_ms" bson:"took_ms"`
+}
+
+// WebhookDelivery : an event queued for a subscription
+type WebhookDelivery struct {
+	ID       bson.ObjectId     `json:"id" bson:"_id"`
+	Sub      bson.ObjectId     `json:"sub" bson:"sub"`
+	Event    Event             `json:"event" bson:"event"`
+	Status   string            `json:"status" bson:"status"` // pending / delivered / failed
+	Attempts []DeliveryAttempt `json:"attempts" bson:"attempts"`
+	NextAt   time.Time         `json:"next_at" bson:"next_at"`
+	Created  time.Time         `json:"created" bson:"created"`
+}
+
+// whBackoff : wait before the next attempt, doubles every attempt
+func whBackoff(attempts int) time.Duration {
+	d := whBaseBackoff
+	for i := 1; i < attempts && d < whMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > whMaxBackoff {
+		d = whMaxBackoff
+	}
+	return d
+}
+
+// whSign : hex hmac sha256 of the timestamp and the body joined with a dot
+func whSign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueueDeliveries : queues the event for all the active subscriptions to it
+func enqueueDeliveries(subs, deliveries *mgo.Collection, ev *Event) error {
+	matching := []WebhookSub{}
+	if err := subs.Find(bson.M{"active": true, "events": bson.M{"$in": []string{ev.Kind, evAny}}}).All(&matching); err != nil {
+		return ex.NewErr(&ex.ErrQuery{}, err, "Failed to get webhook subscriptions", "enqueueDeliveries/subs.Find().All()")
+	}
+	now := time.Now().UTC()
+	for _, s := range matching {
+		d := &WebhookDelivery{ID: bson.NewObjectId(), Sub: s.ID, Event: *ev, Status: "pending", Attempts: []DeliveryAttempt{}, NextAt: now, Created: now}
+		if err := deliveries.Insert(d); err != nil {
+			return ex.NewErr(&ex.ErrQuery{}, err, "Failed to queue webhook delivery", "enqueueDeliveries/deliveries.Insert()")
+		}
+	}
+	return nil
+}
+
+// postDelivery : posts the event to the receiver, any 2xx is a success
+func postDelivery(client *http.Client, sub *WebhookSub, d *WebhookDelivery) DeliveryAttempt {
+	attempt := DeliveryAttempt{At: time.Now().UTC()}
+	body, _ := json.Marshal(d.Event)
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "authapi-webhooks")
+	req.Header.Set("X-Authapi-Event", d.Event.Kind)
+	req.Header.Set("X-Authapi-Delivery", d.ID.Hex())
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Authapi-Timestamp", ts)
+	req.Header.Set("X-Authapi-Signature", "sha256="+whSign(sub.Secret, ts, body))
+	resp, err := client.Do(req)
+	attempt.Took = time.Since(attempt.At).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	attempt.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("receiver responded %s", resp.Status)
+	}
+	return attempt
+}
+
+// claimDelivery : takes up the next due delivery that no other dispatcher has, nil when there is none
+// the delivery is leased till locked_until so that instances running side by side do not post it twice
+func claimDelivery(deliveries *mgo.Collection, now time.Time) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	filter := bson.M{"status": "pending", "next_at": bson.M{"$lte": now}, "$or": []bson.M{
+		{"locked_until": bson.M{"$exists": false}}, {"locked_until": bson.M{"$lte": now}},
+	}}
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"locked_until": now.Add(whLease)}}, ReturnNew: true}
+	if _, err := deliveries.Find(filter).Sort("next_at").Apply(change, d); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, ex.NewErr(&ex.ErrQuery{}, err, "Failed to get due webhook deliveries", "claimDelivery/deliveries.Find().Apply()")
+	}
+	return d, nil
+}
+
+// DeliverDue : posts all the deliveries that are due, sends back the count of deliveries attempted
+// deliveries that fail are retried with backoff until they run out of attempts
+func DeliverDue(subs, deliveries *mgo.Collection, client *http.Client, now time.Time) (int, error) {
+	count := 0
+	for ; count < 100; count++ {
+		d, err := claimDelivery(deliveries, now)
+		if err != nil {
+			return count, err
+		}
+		if d == nil {
+			break
+		}
+		sub := &WebhookSub{}
+		if err := subs.FindId(d.Sub).One(sub); err != nil || !sub.Active {
+			// subscription removed or turned off since the event was queued
+			deliveries.UpdateId(d.ID, bson.M{"$set": bson.M{"status": "failed"}, "$unset": bson.M{"locked_until": ""}})
+			continue
+		}
+		attempt := postDelivery(client, sub, d)
+		set := bson.M{}
+		switch {
+		case attempt.Error == "":
+			set["status"] = "delivered"
+		case len(d.Attempts)+1 >= whMaxAttempts:
+			set["status"] = "failed"
+		default:
+			set["next_at"] = now.Add(whBackoff(len(d.Attempts) + 1))
+		}
+		deliveries.UpdateId(d.ID, bson.M{"$set": set, "$push": bson.M{"attempts": attempt}, "$unset": bson.M{"locked_until": ""}})
+	}
+	return count, nil
+}
+
+// HandlWebhooks : enlisting and registering webhook subscriptions
+func HandlWebhooks(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("webhooks")
+	subs := val.(*mgo.Collection)
+	if c.Request.Method == "GET" {
+		result := []WebhookSub{}
+		if err := subs.Find(bson.M{}).Sort("created").All(&result); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get webhooks", "HandlWebhooks/GET"), c)
+			return
+		}
+		for i := range result {
+			result[i].Secret = "" // secrets are sent out only when the webhook is registered
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	} else if c.Request.Method == "POST" {
+		ws := &WebhookSub{}
+		if err := c.ShouldBindJSON(ws); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrJSONBind{}, err, "Failed to read webhook, kindly check and send again", "HandlWebhooks/POST"), c)
+			return
+		}
+		if DigestErr(ws.validate(), c) != 0 {
+			return
+		}
+		if ws.Secret == "" {
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				DigestErr(ex.NewErr(&ex.ErrEncrypt{}, err, "Failed to generate webhook secret", "HandlWebhooks/rand.Read"), c)
+				return
+			}
+			ws.Secret = hex.EncodeToString(buf)
+		}
+		ws.ID, ws.Active, ws.Created = bson.NewObjectId(), true, time.Now().UTC()
+		if err := subs.Insert(ws); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to register webhook", "HandlWebhooks/subs.Insert()"), c)
+			return
+		}
+		c.JSON(http.StatusOK, ws)
+		return
+	}
+}
+
+// HandlWebhook : getting, turning on/off or removing a webhook subscription
+// /webhooks/:id?active=false pauses the deliveries
+func HandlWebhook(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("webhooks")
+	subs := val.(*mgo.Collection)
+	id := c.Param("id")
+	if !bson.IsObjectIdHex(id) {
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid webhook id", "HandlWebhook"), c)
+		return
+	}
+	ws := &WebhookSub{}
+	if err := subs.FindId(bson.ObjectIdHex(id)).One(ws); err != nil {
+		if err == mgo.ErrNotFound {
+			DigestErr(ex.NewErr(&ex.ErrNotFound{}, err, "No such webhook", "HandlWebhook"), c)
+			return
+		}
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get webhook", "HandlWebhook/subs.FindId()"), c)
+		return
+	}
+	if c.Request.Method == "GET" {
+		ws.Secret = ""
+		c.JSON(http.StatusOK, ws)
+		return
+	} else if c.Request.Method == "PATCH" {
+		active := c.Query("active")
+		if active != "true" && active != "false" {
+			DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Patching webhook: /webhooks/:id?active=false is the correct format", "HandlWebhook/PATCH"), c)
+			return
+		}
+		if err := subs.UpdateId(ws.ID, bson.M{"$set": bson.M{"active": active == "true"}}); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to update webhook", "HandlWebhook/subs.UpdateId()"), c)
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	} else if c.Request.Method == "DELETE" {
+		if err := subs.RemoveId(ws.ID); err != nil {
+			DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to remove webhook", "HandlWebhook/subs.RemoveId()"), c)
+			return
+		}
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+}
+
+// HandlWebhookLog : latest deliveries for the webhook along with all their attempts
+// /webhooks/:id/deliveries?status=failed
+func HandlWebhookLog(c *gin.Context) {
+	closeSession, _ := c.Get("close_session")
+	defer closeSession.(func())() // this closes the db session when done
+	val, _ := c.Get("whdeliveries")
+	deliveries := val.(*mgo.Collection)
+	id := c.Param("id")
+	if !bson.IsObjectIdHex(id) {
+		DigestErr(ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid webhook id", "HandlWebhookLog"), c)
+		return
+	}
+	filter := bson.M{"sub": bson.ObjectIdHex(id)}
+	if s := c.Query("status"); s != "" {
+		filter["status"] = s
+	}
+	result := []WebhookDelivery{}
+	if err := deliveries.Find(filter).Sort("-_id").Limit(whLogLimit).All(&result); err != nil {
+		DigestErr(ex.NewErr(&ex.ErrQuery{}, err, "Failed to get webhook deliveries", "HandlWebhookLog/deliveries.Find().All()"), c)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestWebhookDelivery : receiver verifies the signature and reads the event
+func TestWebhookDelivery(t *testing.T) {
+	secret := "s3cr3t"
+	var got Event
+	var sigOk bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Authapi-Timestamp"), 10, 64)
+		assert.WithinDuration(t, time.Now(), time.Unix(ts, 0), 5*time.Second, "Timestamp on the delivery")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Authapi-Timestamp") + "."))
+		mac.Write(body)
+		sigOk = hmac.Equal([]byte(r.Header.Get("X-Authapi-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+		json.Unmarshal(body, &got)
+		assert.Equal(t, EvDevLocked, r.Header.Get("X-Authapi-Event"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	sub := &WebhookSub{ID: bson.NewObjectId(), URL: receiver.URL, Events: []string{EvDevLocked}, Secret: secret, Active: true}
+	d := &WebhookDelivery{ID: bson.NewObjectId(), Sub: sub.ID, Event: Event{ID: "ev1", Kind: EvDevLocked, At: time.Now().UTC(), Owner: "someone@gmail.com", Data: map[string]interface{}{"serial": "000000007920365b"}}}
+	attempt := postDelivery(receiver.Client(), sub, d)
+	assert.Empty(t, attempt.Error, "Unexpected error on delivery")
+	assert.Equal(t, http.StatusNoContent, attempt.Status)
+	assert.True(t, sigOk, "Signature on the delivery did not verify")
+	assert.Equal(t, "ev1", got.ID)
+	assert.Equal(t, "someone@gmail.com", got.Owner)
+
+	// a wrong secret on the receiver side fails the verification
+	sub.Secret = "other"
+	postDelivery(receiver.Client(), sub, d)
+	assert.False(t, sigOk, "Signature with the wrong secret should not verify")
+}
+
+// TestWebhookFailedDelivery : non 2xx and unreachable receivers are recorded as failed attempts
+func TestWebhookFailedDelivery(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	sub := &WebhookSub{URL: receiver.URL, Secret: "s3cr3t", Active: true}
+	d := &WebhookDelivery{ID: bson.NewObjectId(), Event: Event{ID: "ev2", Kind: EvUserCreated}}
+	attempt := postDelivery(receiver.Client(), sub, d)
+	assert.Equal(t, http.StatusInternalServerError, attempt.Status)
+	assert.NotEmpty(t, attempt.Error)
+
+	receiver.Close()
+	attempt = postDelivery(&http.Client{Timeout: time.Second}, sub, d)
+	assert.Equal(t, 0, attempt.Status)
+	assert.NotEmpty(t, attempt.Error)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, whBackoff(1))
+	assert.Equal(t, time.Minute, whBackoff(2))
+	assert.Equal(t, 4*time.Minute, whBackoff(4))
+	assert.Equal(t, time.Hour, whBackoff(12))
+}
+
+func TestWebhookValidate(t *testing.T) {
+	assert.Nil(t, (&WebhookSub{URL: "https://example.com/hook", Events: []string{EvDevLocked, EvUserCreated}}).validate())
+	assert.Nil(t, (&WebhookSub{URL: "http://example.com/hook", Events: []string{"*"}}).validate())
+	assert.NotNil(t, (&WebhookSub{URL: "example.com/hook", Events: []string{"*"}}).validate())
+	assert.NotNil(t, (&WebhookSub{URL: "ftp://example.com/hook", Events: []string{"*"}}).validate())
+	assert.NotNil(t, (&WebhookSub{URL: "https://example.com/hook"}).validate())
+	assert.NotNil(t, (&WebhookSub{URL: "https://example.com/hook", Events: []string{"device.exploded"}}).validate())
+}
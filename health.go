@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/eensymachines-in/auth/v2"
+	"github.com/eensymachines-in/authapi/handlers"
+	"github.com/go-redis/redis/v7"
+	"gopkg.in/mgo.v2"
+)
+
+// readyChecks : what /readyz checks, on the connections that live as long as the api instead of dialing on each probe
+// both pools reconnect on their own, a dependency coming back up is seen on the next probe
+func readyChecks(session *mgo.Session, cache *redis.Client) []handlers.HealthCheck {
+	return []handlers.HealthCheck{
+		{Name: "mongo", Check: func() error {
+			sess := session.Copy()
+			defer sess.Close()
+			return sess.Ping()
+		}},
+		{Name: "redis", Check: func() error {
+			return cache.Ping().Err()
+		}},
+		{Name: "secrets", Check: func() error {
+			// mqtt secret is optional, the api runs without the broker
+			for _, key := range []string{"AUTH_SECRET", "REFR_SECRET", "DEVC_SECRET", "HASH_SECRET"} {
+				if os.Getenv(key) == "" {
+					return fmt.Errorf("%s not loaded", key)
+				}
+			}
+			return nil
+		}},
+		{Name: "admin", Check: func() error {
+			sess := session.Copy()
+			defer sess.Close()
+			ua := &auth.UserAccounts{Collection: sess.DB("autolumin").C("userreg")}
+			if !ua.IsRegistered(adminEmail) {
+				return fmt.Errorf("admin account not seeded")
+			}
+			return nil
+		}},
+	}
+}
@@ -9,10 +9,16 @@ import (
 	"github.com/eensymachines-in/authapi/handlers"
 	utl "github.com/eensymachines-in/utilities"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-redis/redis/v7"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/mgo.v2"
 )
 
+// adminEmail : account seeded as the first admin
+const adminEmail = "kneerunjun@gmail.com"
+
 var (
 	// /var/local/authapi : is mapped on the host machine
 	logFile = "/var/local/authapi/server.log"
@@ -20,13 +26,21 @@ var (
 	Flog bool
 	// FVerbose :  determines the level of log
 	FVerbose bool
+	// FConfig : path to the config file
+	FConfig string
+	// redactHook : scrubs credentials and personal data from all the log output
+	redactHook = handlers.NewRedactHook()
 )
 
 func init() {
 	// log file - direction and level
 	utl.SetUpLog()
+	log.AddHook(redactHook)
+	// json bodies with fields that the api does not know of are refused with 400, typos in the field names would otherwise go unnoticed
+	binding.EnableDecoderDisallowUnknownFields = true
 	flag.BoolVar(&Flog, "flog", true, "direction of log messages, set false for terminal logging. Default is true")
 	flag.BoolVar(&FVerbose, "verbose", false, "Determines what level of log messages are to be output")
+	flag.StringVar(&FConfig, "config", "/var/local/authapi/config.json", "Path to the config file, defaults apply when there isnt one")
 	// +++++++++++++++++++ reading the secrets into the environment
 	file, err := os.Open("/run/secrets/auth_secrets")
 	if err != nil {
@@ -48,6 +62,24 @@ func init() {
 	}
 	os.Setenv("REFR_SECRET", string(line))
 	// log.Infof("The refresh secret %s", os.Getenv("REFR_SECRET"))
+	// ++++++++++++++++++++ reading in the device secret
+	line, _, err = reader.ReadLine()
+	if err != nil {
+		log.Error("Error reading the device secret from file")
+	}
+	os.Setenv("DEVC_SECRET", string(line))
+	// ++++++++++++++++++++ reading in the mqtt secret, the api connects to the broker with this
+	line, _, err = reader.ReadLine()
+	if err != nil {
+		log.Warn("No mqtt secret in the secrets file, the api cannot connect to the broker")
+	}
+	os.Setenv("MQTT_SECRET", string(line))
+	// ++++++++++++++++++++ reading in the key for the hashes of the emails in the audit trail and the pseudonyms of erased accounts
+	line, _, err = reader.ReadLine()
+	if err != nil {
+		log.Error("Error reading the hash secret from file")
+	}
+	os.Setenv("HASH_SECRET", string(line))
 	// ++++++++++ Now reading the admin secret and creating a user if not already created
 	file1, err := os.Open("/run/secrets/admin_secret")
 	if err != nil {
@@ -71,7 +103,7 @@ func seedAdminUserAccount() error {
 		log.Fatal("Could not seed the admin to the database")
 	}
 	ua := &auth.UserAccounts{Collection: session.DB("autolumin").C("userreg")}
-	if ua.IsRegistered("kneerunjun@gmail.com") {
+	if ua.IsRegistered(adminEmail) {
 		return nil
 	}
 	// +++++++++ else we would want to register the user account
@@ -79,13 +111,16 @@ func seedAdminUserAccount() error {
 	// the host machine shall have the file which is then loaded onto the guest machine at the run
 	// pushing the same onto the host machine though would be the job of the CI/CD
 	return ua.InsertAccount(&auth.UserAccDetails{Name: "Niranjan", Phone: "+918390906860", Loc: "Pune", UserAcc: auth.UserAcc{
-		Email:  "kneerunjun@gmail.com",
+		Email:  adminEmail,
 		Passwd: os.Getenv("ADMIN_SECRET"),
 		Role:   2,
 	}})
 
 }
 func main() {
+	// exits after all the deferred calls are done, os.Exit would skip them
+	exitCode := 0
+	defer func() { os.Exit(exitCode) }()
 	// Setting the log direction and the level of log
 	flag.Parse()
 	closeLogFile := utl.CustomLog(Flog, FVerbose, logFile)
@@ -95,55 +130,225 @@ func main() {
 		"verbose": FVerbose,
 	}).Info("Starting authapi module")
 
+	cfg, err := loadConfig(FConfig)
+	if err != nil {
+		log.Fatalf("Failed to load configuration, cannot continue %s", err)
+	}
+	redactHook.SetPII(cfg.LogPII...)
+	// tokens signed with an empty key can be forged, device tokens live for a year
+	// unkeyed, the hashes in the audit trail and the pseudonyms could be matched to a list of emails
+	for _, key := range []string{"AUTH_SECRET", "REFR_SECRET", "DEVC_SECRET", "HASH_SECRET"} {
+		if os.Getenv(key) == "" {
+			log.Fatalf("No %s in the secrets file, cannot continue", key)
+		}
+	}
+	shutdownTracing, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to setup tracing, cannot continue %s", err)
+	}
+	defer shutdownTracing()
+	handlers.HeartbeatTimeout = cfg.HeartbeatTimeout.Duration
+	handlers.CommandTTL = cfg.CommandTTL.Duration
+	handlers.Tokens = cfg.Tokens.policy()
+	handlers.MQTTServiceUser = cfg.MQTTUser
+	if cfg.MQTTBroker != "" {
+		push, disconnect, err := mqttCommandPush(cfg.MQTTBroker, cfg.MQTTUser, os.Getenv("MQTT_SECRET"))
+		if err != nil {
+			// devices still get the commands on the long-poll
+			log.Errorf("Failed to connect to mqtt broker %s, commands will be delivered on long-poll only: %s", cfg.MQTTBroker, err)
+		} else {
+			handlers.CommandPush = push
+			defer disconnect()
+		}
+	}
 	//+++++++++++ now inserting the admin user if not already exists
 	if err := seedAdminUserAccount(); err != nil {
 		log.Fatalf("Failed to insert admin account seed, cannot continue %s", err)
 	}
+	// ++++++++++++ events are queued for the webhooks and the audit trail recorded on a session that lives as long as the api
+	evSession, err := mgo.Dial("srvmongo")
+	if err != nil {
+		log.Fatalf("Failed to connect to database for events, cannot continue %s", err)
+	}
+	defer evSession.Close()
+	handlers.Audit = handlers.NewAuditLog(evSession)
+	handlers.PollSession = evSession
+	evCache := redis.NewClient(&redis.Options{
+		Addr:     "srvredis:6379",
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})
+	defer evCache.Close()
+	handlers.Events = handlers.NewEventBus(evSession, evCache)
+	defer handlers.Events.Close() // queued events go out before the session and the cache close
+	handlers.TokenGens = handlers.NewTokenGenerations(evCache)
+	// ++++++++++++ background tasks
+	go flushHeartbeats(cfg.HeartbeatFlush.Duration)
+	go runLockSchedules()
+	go dispatchWebhooks(cfg.WebhookDispatch.Duration)
+	go sampleDevices(cfg.MetricsSample.Duration)
 	// ++++++++++++ Now setting up the routes
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-	r.Use(CORS)
+	// access log is json lines on the same output as the rest of the logs
+	accessLogger := log.New()
+	accessLogger.SetOutput(log.StandardLogger().Out)
+	accessLogger.SetFormatter(&log.JSONFormatter{})
+	accessLogger.AddHook(redactHook)
+	r := gin.New()
+	r.Use(requestID())
+	r.Use(tracing())
+	r.Use(accessLog(accessLogger))
+	r.Use(metrics())
+	r.Use(gin.Recovery())
+	r.Use(secureHeaders(cfg.Security))
+	r.Use(CORS(cfg.CORS))
+	r.Use(bodyLimit(cfg.Security))
+	handlers.WSOriginAllowed = newOriginMatcher(cfg.CORS.AllowOrigins).allowed
+	r.Use(auditTrail())
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
 		})
 	})
+	// for the orchestrator - liveness, readiness with a report on each dependency and the build info
+	handlers.ReadyChecks = readyChecks(evSession, evCache)
+	r.GET("/healthz", handlers.HandlHealthz)
+	r.GET("/readyz", handlers.HandlReadyz)
+	r.GET("/version", handlers.HandlVersion)
 	// devices group
 	devices := r.Group("/devices")
 	devices.Use(lclDbConnect())
 
-	devices.GET("", handlers.HandlDevices)  // filtered list of devices /devices?black=true
-	devices.POST("", handlers.HandlDevices) // when creating new registrations
+	// filtered list of devices /devices?black=true, the listing of all the devices /devices?model=&lock= is for admins only
+	devices.GET("", unlessQuery("black", tokenParse(), verifyRole(2)), handlers.HandlDevices)
+	devices.POST("", noStore(), handlers.HandlDevices) // when creating new registrations
 
-	devices.GET("/:serial", handlers.HandlDevice) // when getting existing registrations
+	// existing registrations are open to all, the metadata only to the owner or the admins
+	// the cache only adds the liveliness, the registration is served when it is down
+	devices.GET("/:serial", ifHeader("Authorization", tokenParse()), optCacConnect(), handlers.HandlDevice)
+	// devices report in with the token they got on registration
+	devices.POST("/:serial/heartbeat", deviceTokenParse(), lclCacConnect(), handlers.HandlDevHeartbeat)
+	devices.POST("/:serial/token", noStore(), tokenParse(), handlers.HandlDevToken) // owner getting a fresh token for the device
+	// devices long-poll for their commands and acknowledge them, operators queue commands
+	devices.GET("/:serial/commands", deviceTokenParse(), handlers.HandlDevCommands)
+	devices.POST("/:serial/commands/:id/ack", noStore(), deviceTokenParse(), handlers.HandlDevCmdAck)
+	devices.POST("/:serial/commands", tokenParse(), verifyRole(1), handlers.HandlDevCommands)
+	// owner given name, labels, location and attributes
+	devices.GET("/:serial/meta", tokenParse(), handlers.HandlDevMeta)
+	devices.PUT("/:serial/meta", tokenParse(), handlers.HandlDevMeta)
+	devices.PATCH("/:serial/meta", tokenParse(), handlers.HandlDevMeta)
 	// When the device registration has to be modified or deleted
 	devices.PATCH("/:serial", tokenParse(), verifyRole(1), handlers.HandlDevice)
 	devices.DELETE("/:serial", tokenParse(), verifyRole(2), handlers.HandlDevice)
 
+	// device groups, static lists of serials or queries on owner/model/labels
+	groups := r.Group("/groups")
+	groups.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(1))
+	groups.GET("", handlers.HandlGroups)
+	groups.POST("", handlers.HandlGroups)
+	groups.GET("/:name", handlers.HandlGroup) // group along with its current members
+	groups.PUT("/:name", handlers.HandlGroup)
+	groups.DELETE("/:name", handlers.HandlGroup)
+
+	// lock/unlock/black/white on a group or a list of serials
+	bulk := r.Group("/bulk")
+	bulk.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(1))
+	bulk.POST("", handlers.HandlBulk)
+	bulk.GET("/:id", handlers.HandlBulk) // progress of the bulk job running in the background
+
+	// devices or groups locked outside of weekly windows
+	schedules := r.Group("/schedules")
+	schedules.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(1))
+	schedules.GET("", handlers.HandlSchedules)
+	schedules.POST("", handlers.HandlSchedules)
+	schedules.GET("/:id", handlers.HandlSchedule)
+	schedules.DELETE("/:id", handlers.HandlSchedule)
+
+	// commands across the devices, to find devices not acknowledging
+	commands := r.Group("/commands")
+	commands.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(1))
+	commands.GET("", handlers.HandlCommands)
+
+	// internal routes - only on the internal listener, the broker and prometheus reach them on the private network
+	ir := gin.New()
+	ir.Use(requestID())
+	ir.Use(tracing())
+	ir.Use(accessLog(accessLogger))
+	ir.Use(gin.Recovery())
+	ir.Use(bodyLimit(cfg.Security))
+	// prometheus scrapes from here
+	ir.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// readiness with what failed, the public one leaves the errors out
+	ir.GET("/readyz", handlers.HandlReadyzDetail)
+	// auth plugin for the mqtt broker, 200 allows anything else denies
+	// these tell whose the devices are and who the admins are, they are never on the public listener
+	mqtt := ir.Group("/mqtt")
+	mqtt.Use(lclDbConnect())
+	mqtt.POST("/user", handlers.HandlMQTTUser)
+	mqtt.POST("/superuser", handlers.HandlMQTTSuperuser)
+	mqtt.POST("/acl", handlers.HandlMQTTAcl)
+
+	// audit trail, ?format=jsonl for the export
+	audit := r.Group("/audit")
+	audit.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(2))
+	audit.GET("", handlers.HandlAudit)
+	audit.GET("/verify", handlers.HandlAuditVerify) // checks the hash chain end to end
+
+	// webhook subscriptions, events are posted to the receivers signed with the subscription secret
+	webhooks := r.Group("/webhooks")
+	webhooks.Use(lclDbConnect()).Use(tokenParse()).Use(verifyRole(2))
+	webhooks.GET("", handlers.HandlWebhooks)
+	webhooks.POST("", handlers.HandlWebhooks)
+	webhooks.GET("/:id", handlers.HandlWebhook)
+	webhooks.PATCH("/:id", handlers.HandlWebhook) // ?active=false pauses the deliveries
+	webhooks.DELETE("/:id", handlers.HandlWebhook)
+	webhooks.GET("/:id/deliveries", handlers.HandlWebhookLog) // delivery log with all the attempts
+
+	// live events for dashboards, owners see the events on their devices and admins see all
+	events := r.Group("/events")
+	events.Use(queryToken()).Use(tokenParse()).Use(lclCacConnect())
+	events.GET("", handlers.HandlEventStream)    // server sent events
+	events.GET("/ws", handlers.HandlEventSocket) // websocket
+
 	// Users group
 	users := r.Group("/users")
 	users.Use(lclDbConnect())
 
-	users.POST("", handlers.HndlUsers)                             // new user registrations
-	users.GET("", tokenParse(), verifyRole(2), handlers.HndlUsers) // enlisting the user accounts
-	users.GET("/:email", handlers.HandlUser)                       // get user registration details
-	users.GET("/:email/devices", handlers.HandlUsrDevices)         // get all the user devices
+	users.POST("", handlers.HndlUsers)                                                              // new user registrations
+	users.GET("", tokenParse(), verifyRole(2), handlers.HndlUsers)                                  // enlisting the user accounts
+	users.GET("/:email", handlers.HandlUser)                                                        // get user registration details
+	users.GET("/:email/devices", ifHeader("Authorization", tokenParse()), handlers.HandlUsrDevices) // ?label= needs the owner's token
+	// personal data export, the account owner or the admin can download the archive
+	users.GET("/:email/export", noStore(), tokenParse(), verifyUserOrRole(2), lclCacConnect(), handlers.HandlUsrExport)
+
+	// sessions of the user, the admins can see and revoke the sessions of any user
+	users.GET("/:email/sessions", tokenParse(), verifyUserOrRole(2), lclCacConnect(), handlers.HandlSessions)
+	users.DELETE("/:email/sessions", tokenParse(), verifyUserOrRole(2), lclCacConnect(), handlers.HandlSessions) // logout everywhere
+	users.DELETE("/:email/sessions/:id", tokenParse(), verifyUserOrRole(2), lclCacConnect(), handlers.HandlSessions)
 
 	users.PUT("/:email", tokenParse(), verifyUser(), handlers.HandlUser) // changing the user account details
 	users.PATCH("/:email", b64UserCredsParse(), handlers.HandlUser)      // update password
 	// +++++++++ to delete an account you need elevated permission and authentication token
+	// /users/:email?erase=true anonymises the account instead of deleting the device trail
 	users.DELETE("/:email", tokenParse(), verifyRole(2), handlers.HandlUser)
+	// deleting the account, changing the password or the role signs the user out everywhere
+	users.PUT("/:email/role", tokenParse(), verifyRole(2), handlers.HandlUserRole)
 
 	// will handle only authentication
 	auths := r.Group("/authenticate")
-	auths.Use(lclCacConnect()).Use(lclDbConnect()).Use(b64UserCredsParse())
+	auths.Use(noStore()).Use(lclCacConnect()).Use(lclDbConnect()).Use(b64UserCredsParse())
 	auths.POST("/:email", handlers.HandlAuth)
 
 	// /authorize/?lvl=2
 	// /authorize/?refresh=true
 	authrz := r.Group("/authorize")
-	authrz.Use(lclCacConnect()).Use(tokenParse())
-	authrz.GET("", handlers.HndlAuthrz)    // verifying the token ?lvl=2 ?refresh=true
-	authrz.DELETE("", handlers.HndlAuthrz) // logging the token out from the cache
-	log.Fatal(r.Run(":8080"))
+	authrz.Use(noStore()).Use(lclCacConnect())
+	// refresh tokens are taken here and on no other route
+	authrz.GET("", ifQuery("refresh", "true", refrTokenParse(), tokenParse()), handlers.HndlAuthrz) // verifying the token ?lvl=2 ?refresh=true
+	authrz.DELETE("", tokenParse(), handlers.HndlAuthrz)                                            // logging the token out from the cache
+	if err := serve(cfg.Server, r, ir); err != nil {
+		log.Errorf("Server failed: %s", err)
+		exitCode = 1
+	}
+	// deferred calls from here on close the stores, flush the traces and the log file
 }
@@ -1,98 +1,329 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	b64 "encoding/base64"
 
 	auth "github.com/eensymachines-in/auth/v2"
+	"github.com/eensymachines-in/authapi/handlers"
 	ex "github.com/eensymachines-in/errx"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/mgo.v2"
 )
 
-// CORS : this shall allow cross origin requests
-// https://asanchez.dev/blog/cors-golang-options/
-func CORS(c *gin.Context) {
-	// First, we add the headers with need to enable CORS
-	// Make sure to adjust these headers to your needs
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "*")
-	c.Header("Access-Control-Allow-Headers", "*")
-	c.Header("Content-Type", "application/json")
-	// Second, we handle the OPTIONS problem
-	if c.Request.Method != "OPTIONS" {
-		c.Next()
-	} else {
-		// Everytime we receive an OPTIONS request,
-		// we just return an HTTP 200 Status Code
-		// Like this, Angular can now do the real
-		// request using any other method than OPTIONS
-		c.AbortWithStatus(http.StatusOK)
+// originMatcher : origin allowed by the exact origin or a pattern, * in a pattern stands for one or more host labels
+// https://*.eensymachines.in matches https://app.eensymachines.in and https://a.b.eensymachines.in but not https://eensymachines.in
+type originMatcher struct {
+	any     bool
+	exact   map[string]bool
+	pattern []*regexp.Regexp
+}
+
+func newOriginMatcher(origins []string) *originMatcher {
+	om := &originMatcher{exact: map[string]bool{}}
+	for _, o := range origins {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		switch {
+		case o == "*":
+			om.any = true
+		case strings.Contains(o, "*"):
+			rx := strings.Replace(regexp.QuoteMeta(o), `\*`, `[a-z0-9-]+(\.[a-z0-9-]+)*`, -1)
+			om.pattern = append(om.pattern, regexp.MustCompile("^"+rx+"$"))
+		default:
+			om.exact[o] = true
+		}
 	}
+	return om
 }
 
-// readAuthHeader : knows how to parse header for authorization
-func readAuthHeader(c *gin.Context, authfield string, hdrValRead func(string) error) error {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		return ex.NewErr(&ex.ErrInvalid{}, nil, "Authorization header is empty", "readAuthHeader/c.GetHeader()")
+func (om *originMatcher) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if om.any || om.exact[origin] {
+		return true
+	}
+	for _, rx := range om.pattern {
+		if rx.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS : cross origin requests from the origins in the config
+// preflights are answered here, 403 when the origin, method or any of the headers asked for are not allowed
+// requests from origins that are not allowed go through without the cors headers, the browser then holds back the response
+func CORS(cfg CORSConfig) gin.HandlerFunc {
+	origins := newOriginMatcher(cfg.AllowOrigins)
+	methods := map[string]bool{}
+	for _, m := range cfg.AllowMethods {
+		methods[strings.ToUpper(m)] = true
+	}
+	headers := map[string]bool{}
+	for _, h := range cfg.AllowHeaders {
+		headers[strings.ToLower(h)] = true
+	}
+	allowMethods := strings.Join(cfg.AllowMethods, ", ")
+	exposeHeaders := strings.Join(cfg.ExposeHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Origin") // caches otherwise serve the response with one origin's headers to another
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			return // same origin or not a browser
+		}
+		preflight := c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != ""
+		if !origins.allowed(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+			return
+		}
+		if origins.any && !cfg.AllowCredentials {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin) // * cannot go with credentials
+		}
+		if cfg.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if exposeHeaders != "" {
+				c.Header("Access-Control-Expose-Headers", exposeHeaders)
+			}
+			return
+		}
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		if !methods[strings.ToUpper(c.GetHeader("Access-Control-Request-Method"))] {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		var asked []string
+		for _, h := range strings.Split(c.GetHeader("Access-Control-Request-Headers"), ",") {
+			if h = strings.TrimSpace(h); h == "" {
+				continue
+			}
+			if !headers[strings.ToLower(h)] {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			asked = append(asked, h)
+		}
+		c.Header("Access-Control-Allow-Methods", allowMethods)
+		if len(asked) > 0 {
+			c.Header("Access-Control-Allow-Headers", strings.Join(asked, ", "))
+		}
+		c.Header("Access-Control-Max-Age", maxAge)
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// secureHeaders : headers that keep the browsers from sniffing, framing or leaking the responses
+// the api serves no html, the content security policy denies everything should a response ever be rendered
+func secureHeaders(cfg SecurityConfig) gin.HandlerFunc {
+	hsts := fmt.Sprintf("max-age=%d; includeSubDomains", int(cfg.HSTSMaxAge.Seconds()))
+	return func(c *gin.Context) {
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("X-Frame-Options", "DENY")
+		c.Header("Referrer-Policy", "no-referrer")
+		c.Header("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		// behind the ingress the tls is terminated before the api
+		if cfg.HSTSMaxAge.Duration > 0 && (c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https") {
+			c.Header("Strict-Transport-Security", hsts)
+		}
+	}
+}
+
+// noStore : responses that carry tokens or personal data are not to be cached anywhere
+func noStore() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+	}
+}
+
+// bodyLimit : refuses request bodies over the limit for the route with 413, before any of the handlers bind them
+// the body is read here and handed on from memory, so a body without a Content-Length is held to the limit too
+func bodyLimit(cfg SecurityConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			return
+		}
+		limit := cfg.MaxBody
+		if l, ok := cfg.RouteMaxBody[c.Request.Method+" "+c.FullPath()]; ok {
+			limit = l
+		}
+		tooLarge := func() {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("Request body too large, has to be within %d bytes", limit)})
+		}
+		if c.Request.ContentLength > limit {
+			tooLarge()
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+		c.Request.Body.Close()
+		if err != nil {
+			handlers.DigestErr(ex.NewErr(&ex.ErrInvalid{}, err, "Failed to read the request body", "bodyLimit"), c)
+			return
+		}
+		if int64(len(body)) > limit {
+			tooLarge()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+}
+
+// authChallenges : WWW-Authenticate sent with the 401s, tells the client what it has to send to get through
+var authChallenges = map[string]string{
+	"Basic":  `Basic realm="authapi", charset="UTF-8"`,
+	"Bearer": `Bearer realm="authapi"`,
+}
+
+// token68Rx : credentials after the scheme, RFC 7235 token68
+var token68Rx = regexp.MustCompile(`^[A-Za-z0-9._~+/-]+=*$`)
+
+// challengeWriter : adds the challenge to any 401 on the route, unless one more specific was set already
+type challengeWriter struct {
+	gin.ResponseWriter
+	challenge string
+}
+
+func (w *challengeWriter) WriteHeader(code int) {
+	if code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+		w.Header().Set("WWW-Authenticate", w.challenge)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// parseAuthHeader : credentials from the Authorization header value, for the scheme expected
+// RFC 7235 - scheme is case insensitive, followed by one or more spaces and then the credentials as a single token68
+// a missing header or a different scheme is 401, a header that cannot be read is 400
+func parseAuthHeader(header, scheme string) (string, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", ex.NewErr(&ex.ErrLogin{}, nil, "Authorization header is empty", "parseAuthHeader")
+	}
+	name, cred := header, ""
+	if sp := strings.IndexByte(header, ' '); sp >= 0 {
+		name, cred = header[:sp], strings.TrimLeft(header[sp:], " ")
+	}
+	if !strings.EqualFold(name, scheme) {
+		return "", ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("authorization scheme %.16q where %s was expected", name, scheme), fmt.Sprintf("Authorization has to be %s", scheme), "parseAuthHeader")
+	}
+	if cred == "" {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "No authorization token found", "parseAuthHeader")
+	}
+	if !token68Rx.MatchString(cred) {
+		return "", ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid authorization header", "parseAuthHeader")
+	}
+	return cred, nil
+}
+
+// parseBasicCreds : user id and password from the basic credentials, RFC 7617
+// user id ends at the first colon, the password can have colons of its own. Both have to be UTF-8 without control characters
+func parseBasicCreds(cred string) (string, string, error) {
+	v, err := b64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return "", "", ex.NewErr(&ex.ErrInvalid{}, err, "Error reading the encrypted credentials", "parseBasicCreds")
+	}
+	if !utf8.Valid(v) {
+		return "", "", ex.NewErr(&ex.ErrInvalid{}, nil, "Credentials have to be UTF-8", "parseBasicCreds")
+	}
+	for _, r := range string(v) {
+		if unicode.IsControl(r) {
+			return "", "", ex.NewErr(&ex.ErrInvalid{}, nil, "Credentials cannot have control characters", "parseBasicCreds")
+		}
 	}
-	// Please see the " " after authfield, do not include from client code
-	parts := strings.Split(authHeader, " ") // Bearer or Basic depending on if its token or the credentials
-	if len(parts) != 2 {
-		return ex.NewErr(&ex.ErrInvalid{}, nil, "Invalid authorization header", "readAuthHeader/strings.Split()")
+	colon := strings.IndexByte(string(v), ':')
+	if colon < 0 {
+		return "", "", ex.NewErr(&ex.ErrLogin{}, nil, "Invalid credentials in the request authorization", "parseBasicCreds")
+	}
+	return string(v[:colon]), string(v[colon+1:]), nil
+}
+
+// readAuthHeader : reads the credentials for the scheme from the header and hands them to hdrValRead
+// installs the challenge for the scheme so that any 401 on the route carries it
+func readAuthHeader(c *gin.Context, authfield string, hdrValRead func(string) error) error {
+	if _, ok := c.Writer.(*challengeWriter); !ok {
+		c.Writer = &challengeWriter{ResponseWriter: c.Writer, challenge: authChallenges[authfield]}
 	}
-	if parts[1] == "" {
-		return ex.NewErr(&ex.ErrInvalid{}, nil, "No authorization token found", "readAuthHeader/strings.Split()")
+	cred, err := parseAuthHeader(c.GetHeader("Authorization"), authfield)
+	if err != nil {
+		return err
 	}
-	return hdrValRead(parts[1]) // this function is customizable by the middle ware function
+	return hdrValRead(cred) // this function is customizable by the middle ware function
 	// Incase of token parse this is a simple TokenStr conversion
 	// while when its credentials - user:passwd after base64 decoding
 }
 
+// invalidToken : bearer token that was sent but did not parse or has expired, RFC 6750 error on the challenge
+func invalidToken(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", authChallenges["Bearer"]+`, error="invalid_token"`)
+	handlers.DigestErr(err, c)
+}
+
+// queryToken : browsers cannot set headers on EventSource or WebSocket, ?access_token= stands in for the bearer token
+// the header when sent takes precedence
+func queryToken() gin.HandlerFunc {
+	return traced("queryToken", func(c *gin.Context) {
+		if tok := c.Query("access_token"); tok != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+tok)
+		}
+	})
+}
+
 // b64UserCredsParse :here we parse in user credentials from the request
 // Incase the email or password is empty this will respond with 401 and not the expected 400
 // 401 makes more sense when we are authenticating it but 400 makes more sense when we are patching the password
 func b64UserCredsParse() gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return traced("b64UserCredsParse", func(c *gin.Context) {
 		// ++++++++++++++++++
 		// Capturing the user account credentials encoded b64 format from
 		var email, passwd string
-		err := readAuthHeader(c, "Basic", func(val string) error {
-			v, err := b64.StdEncoding.DecodeString(val)
-			if err != nil {
-				return ex.NewErr(&ex.ErrInvalid{}, err, "Error reading the encrypted credentials", "b64UserCredsParse/readAuthHeader")
-			}
-			lump := strings.Split(string(v), ":")
-			email = lump[0]
-			passwd = lump[1]
-			return nil
+		err := readAuthHeader(c, "Basic", func(val string) (err error) {
+			email, passwd, err = parseBasicCreds(val)
+			return err
 		})
-		if ex.DigestErr(err, c) != 0 {
+		if handlers.DigestErr(err, c) != 0 {
 			return
 		}
 		if email == "" || passwd == "" {
 			// ++++++++++ incase the readAuthHeader read out empty creds
-			ex.DigestErr(ex.NewErr(&ex.ErrLogin{}, err, "Invalid credentials in the request authorization", "b64UserCredsParse/readAuthHeader"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrLogin{}, err, "Invalid credentials in the request authorization", "b64UserCredsParse/readAuthHeader"), c)
 			return
 		}
 		// ++++++++++++ user email and password are all set and ready to go
 		c.Set("email", email)
 		c.Set("passwd", passwd)
-		log.Infof("Email %s Passwd %s", email, passwd)
-	}
+	})
 }
 
-// tokenParse : from the request this will parse the tokens
+// tokenParse : from the request this will parse the access token
+// refresh tokens are signed with another secret and do not get through here, refrTokenParse takes them on /authorize only
 func tokenParse() gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return traced("tokenParse", func(c *gin.Context) {
 		// ++++++++++++++++++
 		// capturing the string token from the authorization header
 		var ts auth.TokenStr
@@ -100,86 +331,225 @@ func tokenParse() gin.HandlerFunc {
 			ts = auth.TokenStr(val)
 			return nil
 		})
-		if ex.DigestErr(err, c) != 0 {
+		if handlers.DigestErr(err, c) != 0 {
 			return
 		}
 		// ++++++++++++++++++
 		// now converting into token object, and checking for level
-		var tok *auth.JWTok
-		if c.Query("refresh") == "true" {
-			// only if its refresh action then we use the relevant secret
-			// here we dont care about elevation since all what we are here to do is get new tokens
-			tok, err = ts.Parse(os.Getenv("REFR_SECRET"))
-			if ex.DigestErr(err, c) != 0 {
+		tok, err := ts.Parse(os.Getenv("AUTH_SECRET"))
+		if err != nil {
+			invalidToken(c, err)
+			return
+		}
+		// session of the token signed out or revoked
+		live, err := handlers.TokenLive(tok)
+		if handlers.DigestErr(err, c) != 0 {
+			return
+		}
+		if !live {
+			invalidToken(c, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("session of the token of %s has ended", tok.User), "Session has ended, please sign in again", "tokenParse/TokenLive"))
+			return
+		}
+		// here since we are authorizing we check for role level too..
+		// if the url does not specify the query param at all, the level check is avoided completely
+		if c.Query("lvl") != "" {
+			level, err := strconv.Atoi(c.Query("lvl"))
+			if err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
 				return
 			}
-		} else {
-			tok, err = ts.Parse(os.Getenv("AUTH_SECRET"))
-			if ex.DigestErr(err, c) != 0 {
+			if !tok.HasElevation(level) {
+				handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Role of the user does not have sufficient elevation"), "Insufficient privileges to perform this action", "tokenParse/HasElevation"), c)
 				return
 			}
-			// here since we are authorizing we check for role level too..
-			// if the url does not specify the query param at all, the level check is avoided completely
-			if c.Query("lvl") != "" {
-				level, err := strconv.Atoi(c.Query("lvl"))
-				if err != nil {
-					c.AbortWithStatus(http.StatusBadRequest)
-					return
-				}
-				if !tok.HasElevation(level) {
-					ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Role of the user does not have sufficient elevation"), "Insufficient privileges to perform this action", "tokenParse/HasElevation"), c)
-					return
-				}
+		}
+		// account has changed since the token was issued - deleted, role or password changed
+		current, err := handlers.TokenCurrent(tok)
+		if handlers.DigestErr(err, c) != 0 {
+			return
+		}
+		if !current {
+			invalidToken(c, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("token of %s is of an older generation", tok.User), "Account has changed since, please sign in again", "tokenParse/TokenCurrent"))
+			return
+		}
+		c.Set("token", tok)
+	})
+}
+
+// refrTokenParse : refresh token on GET /authorize?refresh=true, the only route that takes one
+// the token has to be of the current generation and is claimed here, a token used already is turned away
+// and revokes the session it was on before any handler gets to it
+func refrTokenParse() gin.HandlerFunc {
+	return traced("refrTokenParse", func(c *gin.Context) {
+		var ts auth.TokenStr
+		err := readAuthHeader(c, "Bearer", func(val string) error {
+			ts = auth.TokenStr(val)
+			return nil
+		})
+		if handlers.DigestErr(err, c) != 0 {
+			return
+		}
+		tok, err := ts.Parse(os.Getenv("REFR_SECRET"))
+		if err != nil {
+			invalidToken(c, err)
+			return
+		}
+		current, err := handlers.TokenCurrent(tok)
+		if handlers.DigestErr(err, c) != 0 {
+			return
+		}
+		if !current {
+			invalidToken(c, ex.NewErr(&ex.ErrTokenExpired{}, fmt.Errorf("token of %s is of an older generation", tok.User), "Account has changed since, please sign in again", "refrTokenParse/TokenCurrent"))
+			return
+		}
+		if err := handlers.ClaimRefresh(c, tok); err != nil {
+			if e, ok := err.(ex.Errx); ok && e.HTTPStatusCode() == http.StatusUnauthorized {
+				invalidToken(c, err)
+				return
 			}
+			handlers.DigestErr(err, c)
+			return
 		}
 		c.Set("token", tok)
+	})
+}
+
+// ifQuery : the first middleware when the query param has the value, else the other
+func ifQuery(key, val string, then, otherwise gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query(key) == val {
+			then(c)
+			return
+		}
+		otherwise(c)
 	}
 }
 
+// deviceTokenParse : devices identify themselves with the token issued at registration
+// the serial on the token has to be the same as the one in the route param
+func deviceTokenParse() gin.HandlerFunc {
+	return traced("deviceTokenParse", func(c *gin.Context) {
+		var ts auth.TokenStr
+		err := readAuthHeader(c, "Bearer", func(val string) error {
+			ts = auth.TokenStr(val)
+			return nil
+		})
+		if handlers.DigestErr(err, c) != 0 {
+			return
+		}
+		tok, err := ts.Parse(os.Getenv("DEVC_SECRET"))
+		if err != nil {
+			invalidToken(c, err)
+			return
+		}
+		if tok.User != c.Param("serial") {
+			invalidToken(c, ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("Device token for %s used for %s", tok.User, c.Param("serial")), "Device token does not belong to the device", "deviceTokenParse"))
+			return
+		}
+		// tokens are rotated, only the latest one issued to the device works
+		if val, ok := c.Get("devreg"); ok {
+			current, err := handlers.DeviceTokenCurrent(val.(*auth.DeviceRegColl), tok)
+			if handlers.DigestErr(err, c) != 0 {
+				return
+			}
+			if !current {
+				invalidToken(c, ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("Device token %s for %s has been rotated", tok.UUID, tok.User), "Device token is no longer valid", "deviceTokenParse"))
+				return
+			}
+		}
+		c.Set("devtoken", tok)
+	})
+}
+
 // verifyUser : this shall follow the tokenParse and then checks to see if the user in the token is same as the one in the param
 // this is vital when it comes to modification of user accouts, only the user himself should be allowed to change details
 func verifyUser() gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return traced("verifyUser", func(c *gin.Context) {
 		val, exists := c.Get("token")
 		if !exists || val == nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No authorization token found on the request that mandates it"), "This request needs authorization. Login again", "verifyUser/exists"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No authorization token found on the request that mandates it"), "This request needs authorization. Login again", "verifyUser/exists"), c)
 			return
 		}
 		tok := val.(*auth.JWTok)
 		if !(tok.User == c.Param("email")) {
-			ex.DigestErr(ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("Token owner mismatches request param"), "There seems to be an issue with your authorization. You are advised to logout and login again", "verifyUser"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrLogin{}, fmt.Errorf("Token owner mismatches request param"), "There seems to be an issue with your authorization. You are advised to logout and login again", "verifyUser"), c)
 			return
 		}
-	}
+	})
+}
+
+// verifyUserOrRole : same as verifyUser but lets through tokens with the given elevation as well
+// for routes that the account owner and the admins can both access
+func verifyUserOrRole(elevation int) gin.HandlerFunc {
+	return traced("verifyUserOrRole", func(c *gin.Context) {
+		val, exists := c.Get("token")
+		if !exists || val == nil {
+			handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No authorization token found on the request that mandates it"), "This request needs authorization. Login again", "verifyUserOrRole/exists"), c)
+			return
+		}
+		tok := val.(*auth.JWTok)
+		if tok.User == c.Param("email") || tok.HasElevation(elevation) {
+			return
+		}
+		handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Token owner mismatches request param and has insufficient elevation"), "Insufficient privileges to perform this action", "verifyUserOrRole"), c)
+	})
 }
 
 // verifyRole : this shall follow the tokenParse and will check if the token has the minimum required elevation
 func verifyRole(elevation int) gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return traced("verifyRole", func(c *gin.Context) {
 		val, exists := c.Get("token")
 		if !exists || val == nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No authorization token found on the request that mandates it"), "This request needs authorization. Login again using admin role", "verifyRole/exists"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("No authorization token found on the request that mandates it"), "This request needs authorization. Login again using admin role", "verifyRole/exists"), c)
 			return
 		}
 		tok := val.(*auth.JWTok)
 		if !tok.HasElevation(elevation) {
-			ex.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Role of the user does not have sufficient elevation"), "Insufficient privileges to perform this action", "verifyRole/HasElevation"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrInsuffPrivlg{}, fmt.Errorf("Role of the user does not have sufficient elevation"), "Insufficient privileges to perform this action", "verifyRole/HasElevation"), c)
+			return
+		}
+	})
+}
+
+// unlessQuery : runs the chain of middleware only when the query param is absent from the request
+// lets an older open variant of the route (/devices?black=true) stay open while the route itself is guarded
+func unlessQuery(key string, chain ...gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query(key) != "" {
 			return
 		}
+		for _, h := range chain {
+			h(c)
+			if c.IsAborted() {
+				return
+			}
+		}
+	}
+}
+
+// ifHeader : runs the chain of middleware only when the request carries the header
+// for routes open to all where a token, when sent, gets the caller more - the owner of the device sees its metadata
+func ifHeader(header string, chain ...gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(header) == "" {
+			return
+		}
+		for _, h := range chain {
+			h(c)
+			if c.IsAborted() {
+				return
+			}
+		}
 	}
 }
 
 // Middleware to connect to redis cache
+// not traced as a middleware, the client holds on to the request context and the commands are spans under the request
 func lclCacConnect() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tkCac := &auth.TokenCache{Client: redis.NewClient(&redis.Options{
-			Addr:     "srvredis:6379",
-			Password: "", // no password set
-			DB:       0,  // use default DB
-		})}
-		err := tkCac.Ping()
+		tkCac, err := dialCache(c)
 		if err != nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, err, "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclCacConnect"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, err, "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclCacConnect"), c)
 		}
 		c.Set("cache", tkCac)
 		c.Set("cache_close", func() {
@@ -188,11 +558,51 @@ func lclCacConnect() gin.HandlerFunc {
 	}
 }
 
+// optCacConnect : cache for the routes that can do without it, the request goes on when the cache is down
+// the handler then finds no cache on the context
+func optCacConnect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tkCac, err := dialCache(c)
+		if err != nil {
+			handlers.Logger(c).Warnf("optCacConnect: cache is down, serving without it: %s", err)
+			tkCac.Close()
+			return
+		}
+		c.Set("cache", tkCac)
+		c.Set("cache_close", func() {
+			tkCac.Close()
+		})
+	}
+}
+
+// dialCache : client on the cache for the request, pinged once
+func dialCache(c *gin.Context) (*auth.TokenCache, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "srvredis:6379",
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})
+	// commands on the cache are spans under the request
+	client.AddHook(handlers.RedisTracing{})
+	tkCac := &auth.TokenCache{Client: client.WithContext(c.Request.Context())}
+	start := time.Now()
+	err := tkCac.Ping()
+	handlers.ObserveStore("redis", "ping", time.Since(start))
+	return tkCac, err
+}
+
 // this one adds database collections to the context
 func lclDbConnect() gin.HandlerFunc {
-	return func(c *gin.Context) {
+	return traced("lclDbConnect", func(c *gin.Context) {
 		ip := "srvmongo"
+		span, endSpan := handlers.StartSpan(c, "mongo.Dial")
+		start := time.Now()
 		session, err := mgo.Dial(ip)
+		handlers.ObserveStore("mongo", "dial", time.Since(start))
+		if err != nil {
+			span.RecordError(err)
+		}
+		endSpan()
 		if err != nil {
 			return
 		}
@@ -203,7 +613,7 @@ func lclDbConnect() gin.HandlerFunc {
 		// Incase the gateway fails and the database connection is not established we have to abort
 		coll := session.DB("autolumin").C("devreg")
 		if coll == nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/devreg"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/devreg"), c)
 			// log.Error("Failed to get collection - 'devreg'")
 			// c.AbortWithError(http.StatusGatewayTimeout, fmt.Errorf("Failed db connection"))
 			return
@@ -212,7 +622,7 @@ func lclDbConnect() gin.HandlerFunc {
 
 		coll = session.DB("autolumin").C("devblacklist")
 		if coll == nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/devblacklist"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/devblacklist"), c)
 			// log.Error("Failed to get collection - 'devblacklist'")
 			// c.AbortWithError(http.StatusBadGateway, fmt.Errorf("Failed database collection connection"))
 			return
@@ -221,12 +631,238 @@ func lclDbConnect() gin.HandlerFunc {
 		// User account registration acocunt
 		coll = session.DB("autolumin").C("userreg")
 		if coll == nil {
-			ex.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/userreg"), c)
+			handlers.DigestErr(ex.NewErr(&ex.ErrConnFailed{}, fmt.Errorf("Failed to connect to autolumin database"), "Server failed to connect to one of its services. Hang in till one of our admins fixes it", "lclDbConnect:autolumin/userreg"), c)
 			return
 		}
 		c.Set("userreg", &auth.UserAccounts{Collection: coll})
+		// last heartbeats of the devices flushed from the cache
+		c.Set("devhealth", session.DB("autolumin").C("devhealth"))
+		// device groups and the bulk actions on them
+		c.Set("devgroups", session.DB("autolumin").C("devgroups"))
+		c.Set("bulkjobs", session.DB("autolumin").C("bulkjobs"))
+		c.Set("lockschedules", session.DB("autolumin").C("lockschedules"))
+		// webhook subscriptions and their delivery queue
+		c.Set("webhooks", session.DB("autolumin").C("webhooks"))
+		c.Set("whdeliveries", session.DB("autolumin").C("whdeliveries"))
+		// commands queued for the devices
+		c.Set("devcmds", session.DB("autolumin").C("devcmds"))
+		c.Set("audit", session.DB("autolumin").C("audit"))
 		// session close callback
 		c.Set("close_session", closeSession)
 		return
+	})
+}
+
+// auditActions : names for the audited routes, the rest are recorded as method and route
+var auditActions = map[string]string{
+	"POST /users":                            "user.create",
+	"PUT /users/:email":                      "user.update",
+	"PATCH /users/:email":                    "user.passwd",
+	"DELETE /users/:email":                   "user.delete",
+	"PUT /users/:email/role":                 "user.role",
+	"GET /users/:email/export":               "user.export",
+	"POST /authenticate/:email":              "user.login",
+	"DELETE /authorize":                      "user.logout",
+	"DELETE /users/:email/sessions":          "session.revoke_all",
+	"DELETE /users/:email/sessions/:id":      "session.revoke",
+	"POST /devices":                          "device.register",
+	"PATCH /devices/:serial":                 "device.patch",
+	"DELETE /devices/:serial":                "device.delete",
+	"POST /devices/:serial/token":            "device.token",
+	"PUT /devices/:serial/meta":              "device.meta",
+	"PATCH /devices/:serial/meta":            "device.meta",
+	"POST /devices/:serial/commands":         "device.command",
+	"POST /devices/:serial/commands/:id/ack": "device.command.ack",
+	"POST /bulk":                             "device.bulk",
+}
+
+// auditSkip : mutating routes that are too chatty or do not change anything
+var auditSkip = map[string]bool{
+	"POST /devices/:serial/heartbeat": true,
+}
+
+// auditTrail : records every mutating request, and the audited reads, once the handler is done
+// the actor is whoever the token (or the credentials) says, the target is the route param
+// request bodies are never recorded, the query is - sans access_token
+func auditTrail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		route := fmt.Sprintf("%s %s", c.Request.Method, c.FullPath())
+		action, named := auditActions[route]
+		if c.FullPath() == "" || auditSkip[route] || (c.Request.Method == "GET" && !named) {
+			return
+		}
+		if !named {
+			action = route
+		}
+		ae := &handlers.AuditEntry{At: time.Now(), RequestID: c.GetString("request_id"), Action: action, Status: c.Writer.Status(), IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+		ae.Outcome = handlers.AuditOutcome(ae.Status)
+		if val, ok := c.Get("token"); ok {
+			tok := val.(*auth.JWTok)
+			ae.Actor, ae.Role = tok.User, tok.Role
+		} else if val, ok := c.Get("devtoken"); ok {
+			ae.Actor = val.(*auth.JWTok).User
+		} else if val, ok := c.Get("email"); ok {
+			ae.Actor = val.(string)
+		}
+		for _, p := range c.Params {
+			if ae.Target == "" {
+				ae.Target = p.Value
+			} else {
+				ae.Detail = strings.TrimPrefix(fmt.Sprintf("%s %s=%s", ae.Detail, p.Key, p.Value), " ")
+			}
+		}
+		if val, ok := c.Get("audit_target"); ok {
+			// handler knows better, erasure for one records the pseudonym and not the email
+			ae.Target = val.(string)
+		}
+		q := c.Request.URL.Query()
+		q.Del("access_token")
+		if enc := q.Encode(); enc != "" {
+			ae.Detail = strings.TrimPrefix(fmt.Sprintf("%s %s", ae.Detail, enc), " ")
+		}
+		handlers.Audit.Record(ae)
+	}
+}
+
+// reqIDRx : request ids taken in from the callers, anything else is replaced with one of our own
+var reqIDRx = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// reqIDWriter : puts the request id in the json error bodies so that support can find the request in the logs
+type reqIDWriter struct {
+	gin.ResponseWriter
+	id      string
+	written bool
+}
+
+func (w *reqIDWriter) Write(b []byte) (int, error) {
+	if w.written || w.Status() < 400 || len(b) < 2 || b[0] != '{' {
+		w.written = true
+		return w.ResponseWriter.Write(b)
+	}
+	w.written = true
+	sep := ","
+	if b[1] == '}' {
+		sep = ""
+	}
+	body := append([]byte(fmt.Sprintf(`{"request_id":%q%s`, w.id, sep)), b[1:]...)
+	if _, err := w.ResponseWriter.Write(body); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// requestID : X-Request-ID from the caller or a new one, sent back on the response
+// handlers log on the request logger (see handlers.Logger) that carries the id
+// route and not the path on the logger, the path could carry tokens in the query
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !reqIDRx.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+		c.Writer = &reqIDWriter{ResponseWriter: c.Writer, id: id}
+		c.Set("logger", log.WithFields(log.Fields{
+			"request_id": id,
+			"method":     c.Request.Method,
+			"route":      c.FullPath(),
+			"ip":         c.ClientIP(),
+		}))
+	}
+}
+
+// accessLog : one json line per request on the logger, once the request is done
+func accessLog(l *log.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		fields := log.Fields{
+			"request_id": c.GetString("request_id"),
+			"method":     c.Request.Method,
+			"route":      c.FullPath(),
+			"status":     c.Writer.Status(),
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"bytes":      c.Writer.Size(),
+			"ip":         c.ClientIP(),
+		}
+		if traceID := c.GetString("trace_id"); traceID != "" {
+			fields["trace_id"] = traceID
+		}
+		if c.FullPath() == "" {
+			fields["path"] = c.Request.URL.Path // unmatched routes, query is left out
+		}
+		if val, ok := c.Get("token"); ok {
+			fields["user_hash"] = handlers.UserHash(val.(*auth.JWTok).User)
+		}
+		if serial := c.Param("serial"); serial != "" {
+			fields["serial"] = serial
+		} else if val, ok := c.Get("devtoken"); ok {
+			fields["serial"] = val.(*auth.JWTok).User
+		}
+		entry := l.WithFields(fields)
+		switch {
+		case c.Writer.Status() >= 500:
+			entry.Error("request")
+		case c.Writer.Status() >= 400:
+			entry.Warn("request")
+		default:
+			entry.Info("request")
+		}
+	}
+}
+
+// metrics : request count and latency by route template, see handlers.ObserveRequest
+func metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		handlers.ObserveRequest(c.FullPath(), c.Request.Method, strconv.Itoa(c.Writer.Status()), time.Since(start))
+	}
+}
+
+// tracing : server span for the request, continues the trace from the traceparent header when the caller sends one
+// the span is named by the route template, the query is left out since it can carry tokens
+func tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := handlers.Tracer().Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPUserAgentKey.String(c.Request.UserAgent()),
+				semconv.NetPeerIPKey.String(c.ClientIP()),
+				attribute.String("request_id", c.GetString("request_id")),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		if sc := span.SpanContext(); sc.IsValid() {
+			// logs and the access log can then be looked up from the trace and the other way round
+			c.Set("trace_id", sc.TraceID().String())
+			c.Set("logger", handlers.Logger(c).WithField("trace_id", sc.TraceID().String()))
+		}
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traced : span for the middleware, a middleware that aborts the request marks its span as an error
+func traced(name string, h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		span, end := handlers.StartSpan(c, "middleware."+name)
+		defer end()
+		h(c)
+		if c.IsAborted() {
+			span.SetStatus(codes.Error, fmt.Sprintf("aborted with %d", c.Writer.Status()))
+		}
 	}
 }
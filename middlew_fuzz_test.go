@@ -0,0 +1,62 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+// fuzz tests need go 1.18, the module is on 1.15 so these are left out of the builds with an older toolchain
+// the table tests in middlew_test.go cover the same ground on 1.15
+
+import (
+	b64 "encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func FuzzParseAuthHeader(f *testing.F) {
+	for _, seed := range []string{"", "Bearer abc", "Basic c29tZW9uZTpwYXNz", "bearer  a.b.c==", "Bearer", "Bearer a b", "Basic:", "\x00 \xff"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		for _, scheme := range []string{"Basic", "Bearer"} {
+			cred, err := parseAuthHeader(header, scheme)
+			if err != nil {
+				status := err.(interface{ HTTPStatusCode() int }).HTTPStatusCode()
+				if status != http.StatusUnauthorized && status != http.StatusBadRequest {
+					t.Fatalf("%q: status %d", header, status)
+				}
+				continue
+			}
+			if !token68Rx.MatchString(cred) || !strings.Contains(header, cred) {
+				t.Fatalf("%q: credentials %q", header, cred)
+			}
+			if scheme == "Basic" {
+				parseBasicCreds(cred) // must not panic
+			}
+		}
+	})
+}
+
+func FuzzParseBasicCreds(f *testing.F) {
+	f.Add("someone@gmail.com", "unjun@41993")
+	f.Add("someone@gmail.com", "pass:with:colons")
+	f.Add("", "")
+	f.Add("ü", " ")
+	f.Fuzz(func(t *testing.T, email, passwd string) {
+		cred := b64.StdEncoding.EncodeToString([]byte(email + ":" + passwd))
+		gotEmail, gotPasswd, err := parseBasicCreds(cred)
+		if err != nil {
+			return // invalid utf-8 or control characters
+		}
+		if strings.Contains(email, ":") {
+			// user id ends at the first colon, the rest goes with the password
+			if gotEmail+":"+gotPasswd != email+":"+passwd || strings.Contains(gotEmail, ":") {
+				t.Fatalf("%q %q: got %q %q", email, passwd, gotEmail, gotPasswd)
+			}
+			return
+		}
+		if gotEmail != email || gotPasswd != passwd {
+			t.Fatalf("%q %q: got %q %q", email, passwd, gotEmail, gotPasswd)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+// corsRouter : router with the cors middleware and a route that answers ok
+func corsRouter(cfg CORSConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CORS(cfg))
+	r.GET("/users/:email", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	return r
+}
+
+func corsRequest(r *gin.Engine, method, origin string, hdrs map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/users/someone@gmail.com", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	cfg := defaultConfig().CORS
+	// no origins by default, cross origin requests get no cors headers
+	w := corsRequest(corsRouter(cfg), "GET", "https://anywhere.in", nil)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "Default is same origin only")
+	w = corsRequest(corsRouter(cfg), "OPTIONS", "https://anywhere.in", map[string]string{"Access-Control-Request-Method": "GET"})
+	assert.Equal(t, http.StatusForbidden, w.Code, "Default is same origin only")
+
+	cfg.AllowOrigins = []string{"https://app.eensymachines.in", "https://*.autolumin.in"}
+	cfg.AllowCredentials = true
+	cfg.MaxAge = duration{5 * time.Minute}
+	r := corsRouter(cfg)
+
+	// allowed origin, exact and on the pattern
+	for _, origin := range []string{"https://app.eensymachines.in", "https://dash.autolumin.in", "https://a.b.autolumin.in"} {
+		w := corsRequest(r, "GET", origin, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "X-Request-ID", w.Header().Get("Access-Control-Expose-Headers"))
+		assert.Contains(t, w.Header()["Vary"], "Origin")
+	}
+	// origins that are not allowed get no cors headers, pattern does not match the bare domain or lookalikes
+	for _, origin := range []string{"https://evil.in", "https://autolumin.in", "http://dash.autolumin.in", "https://dash.autolumin.in.evil.in", "https://app.eensymachines.in:8443"} {
+		w := corsRequest(r, "GET", origin, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), origin)
+		assert.Contains(t, w.Header()["Vary"], "Origin")
+	}
+	// same origin requests carry no cors headers
+	w = corsRequest(r, "GET", "", nil)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// preflight
+	w = corsRequest(r, "OPTIONS", "https://app.eensymachines.in", map[string]string{
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.eensymachines.in", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, PUT, PATCH, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "authorization, content-type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "300", w.Header().Get("Access-Control-Max-Age"))
+	for _, hdrs := range []map[string]string{
+		{"Access-Control-Request-Method": "TRACE"},
+		{"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "authorization, x-forwarded-for"},
+	} {
+		w = corsRequest(r, "OPTIONS", "https://app.eensymachines.in", hdrs)
+		assert.Equal(t, http.StatusForbidden, w.Code, "Preflight asking for what isnt allowed")
+	}
+	w = corsRequest(r, "OPTIONS", "https://evil.in", map[string]string{"Access-Control-Request-Method": "GET"})
+	assert.Equal(t, http.StatusForbidden, w.Code, "Preflight from an origin not allowed")
+
+	// wildcard without credentials is sent as *, the config does not take it with credentials
+	cfg.AllowOrigins = []string{"*"}
+	cfg.AllowCredentials = false
+	w = corsRequest(corsRouter(cfg), "GET", "https://anywhere.in", nil)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Nil(t, cfg.validate())
+	cfg.AllowCredentials = true
+	assert.NotNil(t, cfg.validate(), "Wildcard origin with credentials")
+}
+
+func TestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := defaultConfig().Security
+	cfg.MaxBody = 64
+	cfg.RouteMaxBody = map[string]int64{"POST /devices/:serial/heartbeat": 16}
+	r := gin.New()
+	r.Use(bodyLimit(cfg))
+	bind := func(c *gin.Context) {
+		body := map[string]interface{}{}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.JSON(http.StatusOK, body)
+	}
+	r.POST("/users", bind)
+	r.POST("/devices/:serial/heartbeat", bind)
+	post := func(path, body string, chunked bool) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1 // no Content-Length, the limit is held on the read
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	small := `{"email":"someone@gmail.com"}`
+	large := `{"email":"someone@gmail.com","name":"` + strings.Repeat("a", 64) + `"}`
+	for _, chunked := range []bool{false, true} {
+		assert.Equal(t, http.StatusOK, post("/users", small, chunked))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post("/users", large, chunked))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post("/devices/000000007920365b/heartbeat", small, chunked), "Route limit is lower than the default")
+		assert.Equal(t, http.StatusOK, post("/devices/000000007920365b/heartbeat", `{"ok":1}`, chunked))
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(secureHeaders(defaultConfig().Security))
+	r.GET("/ping", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	r.POST("/authenticate/:email", noStore(), func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+	assert.Contains(t, w.Header().Get("Content-Security-Policy"), "default-src 'none'")
+	assert.Empty(t, w.Header().Get("Strict-Transport-Security"), "No HSTS over plain http")
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+
+	req := httptest.NewRequest("POST", "/authenticate/someone@gmail.com", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "max-age=31536000; includeSubDomains", w.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestUnknownFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// main.init sets this up, the test does not lean on that
+	defer func(disallow bool) { binding.EnableDecoderDisallowUnknownFields = disallow }(binding.EnableDecoderDisallowUnknownFields)
+	binding.EnableDecoderDisallowUnknownFields = true
+	r := gin.New()
+	r.POST("/users", func(c *gin.Context) {
+		ua := &struct {
+			Email string `json:"email"`
+		}{}
+		if err := c.ShouldBindJSON(ua); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.JSON(http.StatusOK, ua)
+	})
+	for body, code := range map[string]int{`{"email":"someone@gmail.com"}`: http.StatusOK, `{"email":"someone@gmail.com","role":2}`: http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+		assert.Equal(t, code, w.Code, body)
+	}
+}
+
+func TestParseAuthHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header, scheme, cred string
+		status               int // 0 when it parses
+	}{
+		{"Bearer abc.def-ghi_jkl~", "Bearer", "abc.def-ghi_jkl~", 0},
+		{"bearer abc", "Bearer", "abc", 0},
+		{"BASIC c29tZW9uZTpwYXNz", "Basic", "c29tZW9uZTpwYXNz", 0},
+		{"Bearer    abc==", "Bearer", "abc==", 0},
+		{"  Bearer abc  ", "Bearer", "abc", 0},
+		{"", "Bearer", "", http.StatusUnauthorized},
+		{"Basic c29tZW9uZTpwYXNz", "Bearer", "", http.StatusUnauthorized},
+		{"Bearer abc", "Basic", "", http.StatusUnauthorized},
+		{"Bearerabc", "Bearer", "", http.StatusUnauthorized},
+		{"abc", "Bearer", "", http.StatusUnauthorized},
+		{"Bearer", "Bearer", "", http.StatusBadRequest},
+		{"Bearer ", "Bearer", "", http.StatusBadRequest},
+		{"Bearer abc def", "Bearer", "", http.StatusBadRequest},
+		{"Bearer a=bc", "Bearer", "", http.StatusBadRequest},
+		{"Bearer abc\x00", "Bearer", "", http.StatusBadRequest},
+	} {
+		cred, err := parseAuthHeader(tc.header, tc.scheme)
+		if tc.status == 0 {
+			assert.Nil(t, err, tc.header)
+			assert.Equal(t, tc.cred, cred)
+			continue
+		}
+		assert.NotNil(t, err, tc.header)
+		assert.Equal(t, tc.status, err.(interface{ HTTPStatusCode() int }).HTTPStatusCode(), tc.header)
+	}
+}
+
+// TestParseBasicCreds : runs on the toolchain of the module, FuzzParseBasicCreds goes further on 1.18 and above
+func TestParseBasicCreds(t *testing.T) {
+	enc := func(s string) string { return b64.StdEncoding.EncodeToString([]byte(s)) }
+	for _, tc := range []struct {
+		cred, email, passwd string
+		ok                  bool
+	}{
+		{enc("someone@gmail.com:unjun@41993"), "someone@gmail.com", "unjun@41993", true},
+		// colons in the password, the email cannot have one so the first colon splits
+		{enc("someone@gmail.com:pass:with:colons"), "someone@gmail.com", "pass:with:colons", true}, // used to be cut at the second colon
+		{enc("someone@gmail.com::"), "someone@gmail.com", ":", true},
+		{enc(":pass"), "", "pass", true}, // b64UserCredsParse refuses the empty email
+		{enc("someone@gmail.com:पासवर्ड"), "someone@gmail.com", "पासवर्ड", true},
+		{enc("someone@gmail.com:"), "someone@gmail.com", "", true}, // b64UserCredsParse refuses the empty password
+		{enc("someone@gmail.com"), "", "", false},                  // used to panic
+		{enc(""), "", "", false},
+		// invalid UTF-8, in the password and in the email
+		{enc("someone@gmail.com:\xff\xfe"), "", "", false},
+		{enc("someone@gmail.com:pass\x80"), "", "", false},
+		{enc("some\xc3one@gmail.com:pass"), "", "", false},
+		{enc("someone@gmail.com:\xed\xa0\x80"), "", "", false}, // surrogate half
+		// control characters
+		{enc("some\none@gmail.com:pass"), "", "", false},
+		{enc("someone@gmail.com:pa\x00ss"), "", "", false},
+		{enc("someone@gmail.com:pass\t"), "", "", false},
+		{enc("someone@gmail.com:pass\r\n"), "", "", false},
+		{enc("someone@gmail.com:pass\x7f"), "", "", false},
+		{enc("someone@gmail.com:pass\u0085"), "", "", false}, // C1 control
+		{"not base64!", "", "", false},
+	} {
+		email, passwd, err := parseBasicCreds(tc.cred)
+		if !tc.ok {
+			assert.NotNil(t, err, tc.cred)
+			continue
+		}
+		assert.Nil(t, err, tc.cred)
+		assert.Equal(t, tc.email, email)
+		assert.Equal(t, tc.passwd, passwd)
+	}
+}
+
+// TestAuthChallenge : 401s on routes that need authorization carry the challenge for the scheme
+func TestAuthChallenge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) }
+	r.GET("/users", tokenParse(), ok)
+	r.PATCH("/users/:email", b64UserCredsParse(), ok)
+	send := func(method, path, authz string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	basic := "Basic " + b64.StdEncoding.EncodeToString([]byte("someone@gmail.com:unjun@41993"))
+
+	w := send("GET", "/users", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="authapi"`, w.Header().Get("WWW-Authenticate"))
+	w = send("GET", "/users", basic)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Basic credentials on a route that takes the token")
+	assert.Equal(t, `Bearer realm="authapi"`, w.Header().Get("WWW-Authenticate"))
+	w = send("GET", "/users", "Bearer not.a.token")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="authapi", error="invalid_token"`, w.Header().Get("WWW-Authenticate"))
+	w = send("GET", "/users", "Bearer a b")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+	w = send("PATCH", "/users/someone@gmail.com", "Bearer abc")
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Token on a route that takes the credentials")
+	assert.Equal(t, `Basic realm="authapi", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	w = send("PATCH", "/users/someone@gmail.com", "Basic "+b64.StdEncoding.EncodeToString([]byte("nocolon")))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="authapi", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	w = send("PATCH", "/users/someone@gmail.com", basic)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
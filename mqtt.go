@@ -0,0 +1,49 @@
+package main
+
+// Device commands pushed over mqtt, devices subscribe to devices/<serial>/commands
+// the broker is optional, without one devices get their commands on the long-poll
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eensymachines-in/authapi/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+// mqttCommandPush : connects to the broker and sends back the function that publishes the commands
+// api connects as the service user which is the superuser on the broker, see handlers.HandlMQTTSuperuser
+// connection is kept up by the client, publishing while disconnected fails and the command waits for the long-poll
+func mqttCommandPush(broker, user, passwd string) (func(*handlers.DevCommand) error, func(), error) {
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID("authapi-cmds").SetUsername(user).SetPassword(passwd).
+		SetAutoReconnect(true).SetConnectRetry(true).SetConnectTimeout(5 * time.Second)
+	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
+		log.Warnf("mqttCommandPush: lost connection to broker %s", err)
+	}
+	client := mqtt.NewClient(opts)
+	tk := client.Connect()
+	if !tk.WaitTimeout(5 * time.Second) {
+		client.Disconnect(0) // stops the client retrying in the background
+		return nil, nil, fmt.Errorf("timed out connecting to broker")
+	}
+	if tk.Error() != nil {
+		return nil, nil, tk.Error()
+	}
+	push := func(cmd *handlers.DevCommand) error {
+		if !client.IsConnectionOpen() {
+			return fmt.Errorf("not connected to broker")
+		}
+		body, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		tk := client.Publish(fmt.Sprintf("devices/%s/commands", cmd.Serial), 1, false, body)
+		if !tk.WaitTimeout(5 * time.Second) {
+			return fmt.Errorf("timed out publishing to broker")
+		}
+		return tk.Error()
+	}
+	return push, func() { client.Disconnect(250) }, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+// The http server and its shutdown
+// SIGTERM / SIGINT stop the listener, requests in flight get till the shutdown timeout to complete
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eensymachines-in/authapi/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader : serves the certificate from the pem files, loaded again when either file changes
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modTime           time.Time
+}
+
+// newCertReloader : loads the certificate right away, a bad pair fails the start
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// lastModified : the later of the modification times of the two files
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload : loads the pair if the files have changed since the last load, true when it did
+// on error the certificate being served stays
+func (cr *certReloader) reload() (bool, error) {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return false, err
+	}
+	cr.mu.RLock()
+	same := cr.cert != nil && modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.modTime = &cert, modTime
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch : checks the files for changes every so often till done is closed
+func (cr *certReloader) watch(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			changed, err := cr.reload()
+			if err != nil {
+				// a renewal half way through writing the files, next tick picks it up
+				log.Errorf("certReloader: failed to reload %s: %s", cr.certFile, err)
+			} else if changed {
+				log.Infof("certReloader: reloaded certificate %s", cr.certFile)
+			}
+		}
+	}
+}
+
+// GetCertificate : for tls.Config
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// newServer : http server on the address with the timeouts from the config
+func newServer(cfg ServerConfig, addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnContext:       handlers.ConnContext,
+	}
+}
+
+// serve : runs the servers till signalled to stop, then drains the requests in flight
+// public is served on the addr, internal - the broker auth plugin and the metrics - on the internal_addr that is not to be exposed
+// returns once both the servers are down, the caller then closes the stores and flushes the logs
+func serve(cfg ServerConfig, public, internal http.Handler) error {
+	srv := newServer(cfg, cfg.Addr, public)
+	isrv := newServer(cfg, cfg.InternalAddr, internal)
+	// streams and long-polls are not waited on, Shutdown would otherwise sit on them till the timeout
+	srv.RegisterOnShutdown(handlers.Drain)
+	done := make(chan struct{})
+	defer close(done)
+	useTLS := cfg.TLSCert != "" && cfg.TLSKey != ""
+	if useTLS {
+		cr, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		go cr.watch(cfg.TLSReload.Duration, done)
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cr.GetCertificate}
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		log.Infof("Listening on %s for the internal routes", cfg.InternalAddr)
+		if err := isrv.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	go func() {
+		log.Infof("Listening on %s tls: %t", cfg.Addr, useTLS)
+		var err error
+		if useTLS {
+			err = srv.ListenAndServeTLS("", "") // certificate comes from GetCertificate
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	var failed error
+	select {
+	case failed = <-errs:
+		log.Errorf("Server failed, shutting down: %s", failed) // the other of the two goes down with it
+	case sig := <-stop:
+		log.Infof("Received %s, shutting down within %s", sig, cfg.ShutdownTimeout.Duration)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range []*http.Server{srv, isrv} {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				// requests still in flight past the deadline are cut off
+				log.Errorf("Shutdown of %s did not complete in time: %s", s.Addr, err)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+	// no new requests now, bulk jobs in the background get what is left of the deadline
+	if err := handlers.WaitBulkJobs(ctx); err != nil {
+		log.Errorf("Bulk jobs did not complete in time, marked interrupted: %s", err)
+	}
+	if failed != nil {
+		return failed
+	}
+	log.Info("Servers shut down, all requests completed")
+	return nil
+}